@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Action moves one duplicate out of the way, or replaces it with a link to
+// Keep, leaving Keep in place.
+type Action struct {
+	GroupID int
+	Op      JournalOp
+	Keep    string
+	Source  string
+	Target  string
+	// MD5 is the source's hash at scan time; the move is refused if the
+	// file has changed since.
+	MD5 [16]byte
+}
+
+// ApplyOptions controls how groups are turned into actions.
+type ApplyOptions struct {
+	Policy        KeepPolicy
+	QuarantineDir string
+	// Root is the scanned directory; quarantined files keep their path
+	// relative to it.
+	Root string
+	// Kinds limits which matches are acted on; nil means every kind.
+	Kinds map[MatchKind]bool
+	// Similarity, if set, is how the groups were found. Visually similar
+	// members are then only moved when they match the keeper itself, not
+	// just another member of its group.
+	Similarity *SimilarityOptions
+}
+
+func parseMatchKinds(s string) (map[MatchKind]bool, error) {
+	kinds := make(map[MatchKind]bool)
+	for _, name := range strings.Split(s, ",") {
+		kind := MatchKind(strings.ToLower(strings.TrimSpace(name)))
+		if kind != MatchIdentical && kind != MatchPixelIdentical && kind != MatchPerceptual {
+			return nil, fmt.Errorf("unknown match kind %q (want %s, %s, %s)", name, MatchIdentical, MatchPixelIdentical, MatchPerceptual)
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// planQuarantine picks a keeper in every group and plans a move into the
+// quarantine directory for each other member. RAW/JPEG pairs and crops are
+// never moved.
+func planQuarantine(groups []DuplicateGroup, opts ApplyOptions) []Action {
+	var actions []Action
+	for _, group := range groups {
+		planGroup(group, opts.Policy, opts.Kinds, func(keep, i int, kind MatchKind) {
+			member := group.Members[i]
+			if opts.Similarity != nil && kind == MatchPerceptual &&
+				!(opts.Similarity.distance(group.Members[keep].ImageInfo, member.ImageInfo) < opts.Similarity.threshold()) {
+				fmt.Fprintf(statusOut, "Leaving %s: it only matches the keeper %s through other images\n", member.Path, group.Members[keep].Path)
+				return
+			}
+			actions = append(actions, Action{
+				GroupID: group.ID,
+				Op:      OpMove,
+				Keep:    group.Members[keep].Path,
+				Source:  member.Path,
+				Target:  quarantinePath(opts.QuarantineDir, opts.Root, member.Path),
+				MD5:     member.FileHash,
+			})
+		})
+	}
+	return actions
+}
+
+// planGroup calls add for every member i of group that can go, with the
+// member kept in its place and how the two match. Only matches of the given
+// kinds count, nil meaning all; unless visually similar images may go, the
+// group is split into sets of exact copies, each with its own keeper. A
+// copy of a RAW file that is never removed goes in favour of that file.
+func planGroup(group DuplicateGroup, policy KeepPolicy, kinds map[MatchKind]bool, add func(keep, i int, kind MatchKind)) {
+	for _, part := range group.parts(kinds) {
+		keeper := policy.keeperOf(group, part)
+		for _, i := range part {
+			keep := keeper
+			if original := group.rawOriginal(i); original >= 0 {
+				keep = original
+			}
+			if keep < 0 || i == keep || !group.removable(i) {
+				continue
+			}
+			if kind := group.matchBetween(keep, i); kinds == nil || kinds[kind] {
+				add(keep, i, kind)
+			}
+		}
+	}
+}
+
+// quarantinePath mirrors path under dir, relative to root. Paths outside
+// root keep their full absolute path below dir.
+func quarantinePath(dir, root, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if root != "" {
+		if absRoot, err := filepath.Abs(root); err == nil && isWithin(abs, absRoot) {
+			if rel, err := filepath.Rel(absRoot, abs); err == nil {
+				return filepath.Join(dir, rel)
+			}
+		}
+	}
+	return filepath.Join(dir, strings.TrimPrefix(abs, filepath.VolumeName(abs)))
+}
+
+// executeActions prints every action and, unless dryRun is set, performs it,
+// recording each one in the journal before it takes effect. Actions that
+// cannot apply to a file, such as a reflink on a filesystem without them,
+// are reported and skipped; any other failure stops the run. It returns how
+// many actions were performed.
+func executeActions(actions []Action, dryRun bool, out io.Writer, journal *Journal, hasher FileHasher) (int, error) {
+	lastGroup := -1
+	done := 0
+	for _, action := range actions {
+		if action.GroupID != lastGroup {
+			fmt.Fprintf(out, "Group %d: keep %s\n", action.GroupID, action.Keep)
+			lastGroup = action.GroupID
+		}
+		if dryRun {
+			fmt.Fprintf(out, "  would %s %s -> %s\n", action.Op, action.Source, action.Target)
+			continue
+		}
+
+		var err error
+		if action.Op == OpMove {
+			err = moveJournaled(action, journal, hasher)
+		} else {
+			err = linkJournaled(action, journal)
+		}
+		if errors.Is(err, errAlreadyLinked) || errors.Is(err, errReflinkUnsupported) {
+			fmt.Fprintf(out, "  skipped %s: %v\n", action.Source, err)
+			continue
+		}
+		if err != nil {
+			return done, fmt.Errorf("%s %s: %w", action.Op, action.Source, err)
+		}
+		done++
+		fmt.Fprintf(out, "  %s %s -> %s\n", pastTense(action.Op), action.Source, action.Target)
+	}
+	return done, nil
+}
+
+func pastTense(op JournalOp) string {
+	return strings.TrimSuffix(string(op), "e") + "ed"
+}
+
+func moveJournaled(action Action, journal *Journal, hasher FileHasher) error {
+	info, err := os.Lstat(action.Source)
+	if err != nil {
+		return err
+	}
+	hash, err := hasher.ComputeFileHash(action.Source)
+	if err != nil {
+		return err
+	}
+	if hash != action.MD5 {
+		return errors.New("file changed since it was scanned")
+	}
+	// Checked before the journal entry, so undo never meets a move that did
+	// not happen
+	if err := checkAbsent(action.Target); err != nil {
+		return err
+	}
+	entry := JournalEntry{
+		Op:       OpMove,
+		Source:   action.Source,
+		Target:   action.Target,
+		MD5:      hex.EncodeToString(hash[:]),
+		Mode:     info.Mode(),
+		Modified: info.ModTime(),
+	}
+	if err := journal.Record(entry); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return moveFile(action.Source, action.Target)
+}
+
+// moveFile renames src to dst, creating parent directories and never
+// overwriting an existing file. Moves across filesystems fall back to a copy
+// followed by removing src.
+func moveFile(src, dst string) error {
+	if err := checkAbsent(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// checkAbsent returns an error unless nothing exists at path.
+func checkAbsent(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(paths[i], []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestParseMatchKinds(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    map[MatchKind]bool
+		wantErr bool
+	}{
+		{"identical", map[MatchKind]bool{MatchIdentical: true}, false},
+		{"identical, Pixel-Identical", map[MatchKind]bool{MatchIdentical: true, MatchPixelIdentical: true}, false},
+		{"identical,pixel-identical,perceptual", map[MatchKind]bool{MatchIdentical: true, MatchPixelIdentical: true, MatchPerceptual: true}, false},
+		{"raw-pair", nil, true},
+		{"crop", nil, true},
+	}
+	for _, tc := range testCases {
+		got, err := parseMatchKinds(tc.input)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("parseMatchKinds(%q) = %v, %v; expected %v (error %v)", tc.input, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestPlanQuarantineChecksDistanceToKeeper(t *testing.T) {
+	opts := SimilarityOptions{Grouping: GroupingTransitive}
+	groups := findSimilarImages(chainImageInfos(), opts)
+	if len(groups) != 1 || len(groups[0].Members) != 3 {
+		t.Fatalf("Expected the chain in one group, got %v", groups)
+	}
+
+	// /a.jpg is kept, and only matches /b.jpg directly
+	policy := KeepPolicy{Rules: []KeepRule{KeepPrefix}, Prefixes: []string{"/a.jpg"}}
+	actions := planQuarantine(groups, ApplyOptions{Policy: policy, QuarantineDir: "/q", Similarity: &opts})
+	if len(actions) != 1 || actions[0].Source != "/b.jpg" {
+		t.Errorf("Expected only /b.jpg to be moved, got %+v", actions)
+	}
+
+	// From the middle of the chain, both ends match the keeper
+	policy.Prefixes = []string{"/b.jpg"}
+	if actions := planQuarantine(groups, ApplyOptions{Policy: policy, QuarantineDir: "/q", Similarity: &opts}); len(actions) != 2 {
+		t.Errorf("Expected both ends of the chain to be moved, got %+v", actions)
+	}
+}
+
+func TestPlanQuarantineRawCopies(t *testing.T) {
+	// A card imported twice: two copies of both the RAW file and its JPEG
+	icon := syntheticImageInfos(1, 13)[0].Icon
+	info := func(path string, file byte) ImageInfo {
+		return ImageInfo{Path: path, FileHash: [16]byte{file}, PixelHash: [16]byte{file}, Icon: icon}
+	}
+	infos := []ImageInfo{info("/a.dng", 1), info("/again/a.dng", 1), info("/a.jpg", 2), info("/again/a.jpg", 2)}
+	groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive})
+	if len(groups) != 1 || groups[0].Kind != MatchPerceptual {
+		t.Fatalf("Expected one perceptual group, got %v", groups)
+	}
+	if keep := groups[0].SuggestedKeep(); !reflect.DeepEqual(keep, []bool{true, false, true, false}) {
+		t.Errorf("Expected to keep one copy of each file, got %v for %v", keep, groups[0].Paths())
+	}
+
+	want := map[string]string{"/again/a.dng": "/a.dng", "/again/a.jpg": "/a.jpg"}
+	for _, actions := range [][]Action{
+		planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q"}),
+		planLinks(groups, defaultKeepPolicy, OpHardlink),
+	} {
+		got := make(map[string]string)
+		for _, action := range actions {
+			got[action.Source] = action.Keep
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected each copy replaced by its original %v, got %+v", want, actions)
+		}
+	}
+}
+
+func TestPlanQuarantine(t *testing.T) {
+	groups := []DuplicateGroup{
+		{ID: 1, Kind: MatchIdentical, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/photos/a.jpg", Size: 10}},
+			{ImageInfo: ImageInfo{Path: "/photos/2020/a copy.jpg", Size: 20}},
+		}},
+		{ID: 2, Kind: MatchPerceptual, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/photos/b.jpg"}},
+			{ImageInfo: ImageInfo{Path: "/elsewhere/b.jpg"}},
+		}},
+	}
+
+	testCases := []struct {
+		name     string
+		kinds    map[MatchKind]bool
+		expected []Action
+	}{
+		{
+			name: "AllKinds",
+			expected: []Action{
+				{GroupID: 1, Op: OpMove, Keep: "/photos/2020/a copy.jpg", Source: "/photos/a.jpg", Target: "/q/a.jpg"},
+				{GroupID: 2, Op: OpMove, Keep: "/photos/b.jpg", Source: "/elsewhere/b.jpg", Target: "/q/elsewhere/b.jpg"},
+			},
+		},
+		{
+			name:  "IdenticalOnly",
+			kinds: map[MatchKind]bool{MatchIdentical: true},
+			expected: []Action{
+				{GroupID: 1, Op: OpMove, Keep: "/photos/2020/a copy.jpg", Source: "/photos/a.jpg", Target: "/q/a.jpg"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actions := planQuarantine(groups, ApplyOptions{
+				Policy:        KeepPolicy{Rules: []KeepRule{KeepLargest}},
+				QuarantineDir: "/q",
+				Root:          "/photos",
+				Kinds:         tc.kinds,
+			})
+			if !reflect.DeepEqual(actions, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, actions)
+			}
+		})
+	}
+}
+
+func TestExecuteActions(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, filepath.Join(dir, "photos"), "keep.jpg", "sub/dupe.jpg")
+	target := filepath.Join(dir, "quarantine", "sub", "dupe.jpg")
+	hash, _ := DefaultFileHasher{}.ComputeFileHash(paths[1])
+	actions := []Action{{GroupID: 1, Op: OpMove, Keep: paths[0], Source: paths[1], Target: target, MD5: hash}}
+
+	var out bytes.Buffer
+	if n, err := executeActions(actions, true, &out, nil, nil); err != nil || n != 0 {
+		t.Fatalf("executeActions(dry run) = %d, %v", n, err)
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("Dry run must not touch files: %v", err)
+	}
+	if !strings.Contains(out.String(), "would move "+paths[1]+" -> "+target) {
+		t.Errorf("Expected the dry run to describe the move, got %q", out.String())
+	}
+
+	journalPath := filepath.Join(dir, "journal.jsonl")
+	journal, err := createJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	out.Reset()
+	if n, err := executeActions(actions, false, &out, journal, DefaultFileHasher{}); err != nil || n != 1 {
+		t.Fatalf("executeActions() = %d, %v", n, err)
+	}
+	if _, err := os.Stat(paths[1]); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be moved away", paths[1])
+	}
+	if content, err := os.ReadFile(target); err != nil || string(content) != "sub/dupe.jpg" {
+		t.Errorf("Expected the quarantined copy at %s, got %q, %v", target, content, err)
+	}
+	if entries, err := readJournal(journalPath); err != nil || len(entries) != 1 {
+		t.Errorf("Expected one journal entry, got %v, %v", entries, err)
+	}
+
+	// Existing files in the quarantine are never overwritten
+	writeFiles(t, filepath.Join(dir, "photos"), "sub/dupe.jpg")
+	if n, err := executeActions(actions, false, &out, journal, DefaultFileHasher{}); err == nil || n != 0 {
+		t.Errorf("Expected an error when the target exists, got %d, %v", n, err)
+	}
+	if entries, err := readJournal(journalPath); err != nil || len(entries) != 1 {
+		t.Errorf("Expected the refused move to stay out of the journal, got %v, %v", entries, err)
+	}
+}
+
+func TestExecuteActionsRefusesChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "keep.jpg", "dupe.jpg")
+	actions := []Action{{GroupID: 1, Op: OpMove, Keep: paths[0], Source: paths[1], Target: filepath.Join(dir, "q", "dupe.jpg")}}
+
+	journal, err := createJournal(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if _, err := executeActions(actions, false, &bytes.Buffer{}, journal, DefaultFileHasher{}); err == nil {
+		t.Errorf("Expected an error for a file whose MD5 no longer matches the scan")
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("Changed file must stay in place: %v", err)
+	}
+}
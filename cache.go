@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// cacheVersion is bumped whenever ImageInfo changes in a way that makes
+// previously cached entries unusable. Mismatched caches are discarded.
+const cacheVersion = 7
+
+type cacheEntry struct {
+	Size    int64
+	ModTime int64
+	Info    ImageInfo
+}
+
+type cacheFile struct {
+	Version int
+	Entries map[string]cacheEntry
+}
+
+// HashCache stores computed ImageInfo values on disk, keyed by absolute path.
+// An entry is only reused while the file's size and modification time match.
+type HashCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+	dirty   bool
+}
+
+func defaultCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "image-dupes", "index"), nil
+}
+
+func newHashCache(path string) *HashCache {
+	return &HashCache{path: path, entries: make(map[string]cacheEntry)}
+}
+
+func loadHashCache(path string) (*HashCache, error) {
+	cache := newHashCache(path)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var data cacheFile
+	if err := gob.NewDecoder(file).Decode(&data); err != nil {
+		return nil, fmt.Errorf("reading hash cache %s: %w", path, err)
+	}
+	if data.Version != cacheVersion {
+		// Stale format; start over and overwrite it on save.
+		cache.dirty = true
+		return cache, nil
+	}
+	if data.Entries != nil {
+		cache.entries = data.Entries
+	}
+	return cache, nil
+}
+
+func (c *HashCache) Lookup(path string, info os.FileInfo) (ImageInfo, bool) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return ImageInfo{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return ImageInfo{}, false
+	}
+
+	result := entry.Info
+	result.Path = path
+	return result, true
+}
+
+func (c *HashCache) Store(path string, info os.FileInfo, imageInfo ImageInfo) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Info:    imageInfo,
+	}
+	c.dirty = true
+}
+
+func (c *HashCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Save writes the cache atomically, so an interrupted run never corrupts it.
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	if err := writeGobAtomic(c.path, cacheFile{Version: cacheVersion, Entries: c.entries}); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
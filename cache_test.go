@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/gob"
+	"image"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// Counts how often the opener is actually called
+type countingImageOpener struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingImageOpener) Open(path string) (image.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return &image.RGBA{}, nil
+}
+
+func TestHashCacheLookup(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "image.jpg")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	cache := newHashCache(filepath.Join(tempDir, "index"))
+	if _, ok := cache.Lookup(path, stat); ok {
+		t.Errorf("Expected a miss on an empty cache")
+	}
+
+	info := ImageInfo{Path: path, FileHash: [16]byte{1}, Icon: images4.IconT{Pixels: []uint16{1, 2, 3}}}
+	cache.Store(path, stat, info)
+
+	got, ok := cache.Lookup(path, stat)
+	if !ok {
+		t.Fatalf("Expected a hit after Store")
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("Expected %+v, got %+v", info, got)
+	}
+
+	// Relative and absolute spellings of the same file share an entry
+	rel, err := filepath.Rel(mustGetwd(t), path)
+	if err == nil {
+		if got, ok := cache.Lookup(rel, stat); !ok || got.Path != rel {
+			t.Errorf("Expected a hit for relative path %s, got %+v (ok=%v)", rel, got, ok)
+		}
+	}
+
+	// A modified file must not be served from the cache
+	later := stat.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("Failed to change mtime: %v", err)
+	}
+	touched, _ := os.Stat(path)
+	if _, ok := cache.Lookup(path, touched); ok {
+		t.Errorf("Expected a miss after mtime change")
+	}
+
+	if err := os.WriteFile(path, []byte("longer content"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite file: %v", err)
+	}
+	resized, _ := os.Stat(path)
+	if _, ok := cache.Lookup(path, resized); ok {
+		t.Errorf("Expected a miss after size change")
+	}
+}
+
+func TestHashCacheSaveAndLoad(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "image.jpg")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	stat, _ := os.Stat(path)
+
+	indexPath := filepath.Join(tempDir, "nested", "index")
+	cache := newHashCache(indexPath)
+	info := ImageInfo{Path: path, FileHash: [16]byte{7}, Icon: images4.IconT{Pixels: []uint16{4, 5, 6}, ImgSize: image.Point{X: 4, Y: 3}}}
+	cache.Store(path, stat, info)
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := loadHashCache(indexPath)
+	if err != nil {
+		t.Fatalf("loadHashCache failed: %v", err)
+	}
+	got, ok := loaded.Lookup(path, stat)
+	if !ok {
+		t.Fatalf("Expected a hit after reload")
+	}
+	if !reflect.DeepEqual(got, info) {
+		t.Errorf("Expected %+v, got %+v", info, got)
+	}
+
+	t.Run("MissingFile", func(t *testing.T) {
+		cache, err := loadHashCache(filepath.Join(tempDir, "does-not-exist"))
+		if err != nil {
+			t.Fatalf("Expected no error for a missing cache, got %v", err)
+		}
+		if cache.Len() != 0 {
+			t.Errorf("Expected an empty cache, got %d entries", cache.Len())
+		}
+	})
+
+	t.Run("CorruptFile", func(t *testing.T) {
+		corrupt := filepath.Join(tempDir, "corrupt")
+		if err := os.WriteFile(corrupt, []byte("not a gob"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if _, err := loadHashCache(corrupt); err == nil {
+			t.Errorf("Expected an error for a corrupt cache")
+		}
+	})
+
+	t.Run("OldVersion", func(t *testing.T) {
+		old := filepath.Join(tempDir, "old")
+		file, err := os.Create(old)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		entries := map[string]cacheEntry{path: {Size: stat.Size(), ModTime: stat.ModTime().UnixNano(), Info: info}}
+		if err := gob.NewEncoder(file).Encode(cacheFile{Version: cacheVersion - 1, Entries: entries}); err != nil {
+			t.Fatalf("Failed to encode cache: %v", err)
+		}
+		file.Close()
+
+		cache, err := loadHashCache(old)
+		if err != nil {
+			t.Fatalf("loadHashCache failed: %v", err)
+		}
+		if cache.Len() != 0 {
+			t.Errorf("Expected entries from an old cache version to be discarded, got %d", cache.Len())
+		}
+	})
+}
+
+func TestComputeHashesUsesCache(t *testing.T) {
+	tempDir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		path := filepath.Join(tempDir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	cache := newHashCache(filepath.Join(tempDir, "index"))
+
+	opener := &countingImageOpener{}
+	progress := make(chan string, len(paths))
+	first, err := computeHashes(paths, progress, opener, MockIconCreator{}, MockFileHasher{}, 2, cache)
+	if err != nil {
+		t.Fatalf("computeHashes returned an error: %v", err)
+	}
+	if opener.calls != len(paths) {
+		t.Errorf("Expected %d opener calls on a cold cache, got %d", len(paths), opener.calls)
+	}
+
+	opener = &countingImageOpener{}
+	progress = make(chan string, len(paths))
+	second, err := computeHashes(paths, progress, opener, MockIconCreator{}, MockFileHasher{}, 2, cache)
+	if err != nil {
+		t.Fatalf("computeHashes returned an error: %v", err)
+	}
+	if opener.calls != 0 {
+		t.Errorf("Expected no opener calls on a warm cache, got %d", opener.calls)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected cached results %+v to match computed results %+v", second, first)
+	}
+}
+
+func mustGetwd(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	return wd
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/briandowns/spinner"
+)
+
+// Flags shared between commands are grouped into configs that register
+// themselves on a command's FlagSet and are validated after parsing.
+
+type scanConfig struct {
+	workers      int
+	cachePath    string
+	noCache      bool
+	rebuildCache bool
+	include      stringList
+	exclude      stringList
+	types        string
+	sniff        bool
+	mismatches   string
+
+	typeSet map[string]bool
+
+	// found collects the mismatches of every scan, for commands that scan
+	// more than once
+	found []TypeMismatch
+}
+
+func addScanFlags(flags *flag.FlagSet) *scanConfig {
+	c := &scanConfig{}
+	flags.IntVar(&c.workers, "workers", runtime.GOMAXPROCS(0), "Number of images to hash in parallel")
+	flags.StringVar(&c.cachePath, "cache", "", "Hash cache file (default is the user cache directory)")
+	flags.BoolVar(&c.noCache, "no-cache", false, "Do not read or write the hash cache")
+	flags.BoolVar(&c.rebuildCache, "rebuild-cache", false, "Ignore cached hashes and recompute every image")
+	flags.Var(&c.include, "include", "Only scan files matching this .dupeignore-style pattern; repeat for several")
+	flags.Var(&c.exclude, "exclude", "Skip files and directories matching this .dupeignore-style pattern; repeat for several")
+	flags.StringVar(&c.types, "types", strings.Join(imageFormats, ","), "Comma-separated image formats to scan: "+strings.Join(imageFormats, ", "))
+	flags.BoolVar(&c.sniff, "sniff", false, "Detect images by their content instead of their extension, and report files whose extension does not match")
+	flags.StringVar(&c.mismatches, "mismatches", "", "With -sniff, also write the extension mismatches to this CSV file")
+	return c
+}
+
+func (c *scanConfig) validate() error {
+	var err error
+	c.typeSet, err = parseImageTypes(c.types)
+	return err
+}
+
+func (c *scanConfig) filter() ScanFilter {
+	return ScanFilter{Include: c.include, Exclude: c.exclude, Types: c.typeSet, AnyExtension: c.sniff}
+}
+
+// findImages lists the images selected by input, sniffing their content
+// with -sniff.
+func (c *scanConfig) findImages(input *inputConfig) ([]string, error) {
+	paths, err := input.paths(c.filter())
+	if err != nil {
+		return nil, err
+	}
+	if c.sniff {
+		fmt.Fprintf(statusOut, "Checking the content of %d files...\n", len(paths))
+		var mismatches []TypeMismatch
+		paths, mismatches = sniffImages(paths, c.typeSet)
+		c.reportMismatches(mismatches)
+	}
+	fmt.Fprintf(statusOut, "Found %d images\n", len(paths))
+	return paths, nil
+}
+
+func (c *scanConfig) reportMismatches(mismatches []TypeMismatch) {
+	if len(mismatches) > 0 {
+		fmt.Fprintf(statusOut, "%d files have an extension that does not match their content:\n", len(mismatches))
+		for _, m := range mismatches {
+			fmt.Fprintf(statusOut, "  %s: %s\n", m.Path, m.describe())
+		}
+	}
+	if c.mismatches == "" {
+		return
+	}
+	c.found = append(c.found, mismatches...)
+	if err := writeMismatchReport(c.found, c.mismatches); err != nil {
+		fmt.Fprintf(statusOut, "Error writing mismatch report: %v\n", err)
+	} else {
+		fmt.Fprintf(statusOut, "Mismatch report written: %s\n", c.mismatches)
+	}
+}
+
+// scan hashes the given images, using the hash cache.
+func (c *scanConfig) scan(paths []string) ([]ImageInfo, error) {
+	cache := openHashCache(c.cachePath, c.noCache, c.rebuildCache)
+
+	fmt.Fprintln(statusOut, "Computing image hashes...")
+	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond, spinner.WithWriterFile(statusOut))
+	s.Start()
+
+	progressChan := make(chan string)
+	go func() {
+		for msg := range progressChan {
+			s.Suffix = " " + msg
+		}
+	}()
+
+	imageInfos, err := computeHashes(paths, progressChan, RawImageOpener{Next: DefaultImageOpener{}}, DefaultIconCreator{}, DefaultFileHasher{}, c.workers, cache)
+	s.Stop()
+	close(progressChan)
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			fmt.Fprintf(statusOut, "Error saving hash cache: %v\n", err)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("computing hashes: %w", err)
+	}
+	fmt.Fprintf(statusOut, "Computed hashes for %d images\n", len(imageInfos))
+	return imageInfos, nil
+}
+
+// stringList is a flag that can be repeated, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// inputConfig selects the images to scan: any number of root directories
+// and a list of files.
+type inputConfig struct {
+	dirs      stringList
+	filesFrom string
+}
+
+func addInputFlags(flags *flag.FlagSet) *inputConfig {
+	c := &inputConfig{}
+	flags.Var(&c.dirs, "dir", "Root directory to scan for images; repeat for several")
+	flags.StringVar(&c.filesFrom, "files-from", "", "Also scan the images listed in this file, one per line or NUL-separated; \"-\" reads stdin")
+	return c
+}
+
+func (c *inputConfig) given() bool {
+	return len(c.dirs) > 0 || c.filesFrom != ""
+}
+
+// paths finds every image under the roots and in the file list, each
+// listed once. Only the extension check of the filter applies to listed
+// files.
+func (c *inputConfig) paths(filter ScanFilter) ([]string, error) {
+	var paths []string
+	for _, dir := range c.dirs {
+		fmt.Fprintf(statusOut, "Scanning %s for images...\n", dir)
+		images, err := scanDirectoryFiltered(dir, filter)
+		if err != nil {
+			return nil, fmt.Errorf("scanning directory: %w", err)
+		}
+		paths = append(paths, images...)
+	}
+	if c.filesFrom != "" {
+		listed, err := c.readFilesFrom()
+		if err != nil {
+			return nil, fmt.Errorf("reading file list: %w", err)
+		}
+		for _, path := range listed {
+			if filter.AnyExtension || isImageFile(path, filter.Types) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return uniquePaths(paths), nil
+}
+
+func (c *inputConfig) readFilesFrom() ([]string, error) {
+	if c.filesFrom == "-" {
+		fmt.Fprintln(statusOut, "Reading the file list from stdin...")
+		return readFileList(os.Stdin)
+	}
+	fmt.Fprintf(statusOut, "Reading the file list from %s...\n", c.filesFrom)
+	file, err := os.Open(c.filesFrom)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readFileList(file)
+}
+
+// scanInput finds the images selected by input and hashes them.
+func (c *scanConfig) scanInput(input *inputConfig) ([]ImageInfo, error) {
+	paths, err := c.findImages(input)
+	if err != nil {
+		return nil, err
+	}
+	return c.scan(paths)
+}
+
+// sourceConfig lets a command read a saved index or scan directories on the
+// fly.
+type sourceConfig struct {
+	*scanConfig
+	*inputConfig
+	index string
+}
+
+func addSourceFlags(flags *flag.FlagSet) *sourceConfig {
+	c := &sourceConfig{scanConfig: addScanFlags(flags), inputConfig: addInputFlags(flags)}
+	flags.StringVar(&c.index, "index", "", "Index written by the scan command, instead of scanning -dir")
+	return c
+}
+
+func (c *sourceConfig) load() (ScanIndex, error) {
+	switch {
+	case c.index != "" && c.given():
+		return ScanIndex{}, errors.New("use either -index or -dir and -files-from, not both")
+	case c.index != "":
+		index, err := loadIndex(c.index)
+		if err != nil {
+			return ScanIndex{}, err
+		}
+		fmt.Fprintf(statusOut, "Loaded %d images scanned %s from %s\n", len(index.Images), index.Created.Format(time.DateTime), c.index)
+		return index, nil
+	case c.given():
+		images, err := c.scanInput(c.inputConfig)
+		if err != nil {
+			return ScanIndex{}, err
+		}
+		return ScanIndex{Roots: c.dirs, Created: time.Now(), Images: images}, nil
+	}
+	return ScanIndex{}, errors.New("please specify an index using -index, or the images using -dir or -files-from")
+}
+
+type groupConfig struct {
+	grouping        string
+	threshold       string
+	algorithm       string
+	ensemble        string
+	quorum          int
+	matchTransforms bool
+	findCrops       bool
+}
+
+func addGroupFlags(flags *flag.FlagSet) *groupConfig {
+	c := addMatchFlags(flags)
+	flags.StringVar(&c.grouping, "grouping", string(GroupingTransitive), "How similar images form groups: transitive, anchor or clique")
+	flags.BoolVar(&c.findCrops, "find-crops", false, "Also group crops and letterboxed or padded copies with the image they come from; slow, as every pair of images is searched")
+	return c
+}
+
+// addMatchFlags adds only the flags deciding whether two images match, for
+// compare, which matches images against an archive rather than grouping
+// them.
+func addMatchFlags(flags *flag.FlagSet) *groupConfig {
+	c := &groupConfig{grouping: string(GroupingTransitive)}
+	flags.StringVar(&c.threshold, "threshold", "default", "Similarity threshold: strict, default, loose or a multiplier of the default limits")
+	flags.StringVar(&c.algorithm, "algo", string(AlgoIcon), "Perceptual hash to compare with: icon, ahash, dhash, phash or whash")
+	flags.StringVar(&c.ensemble, "ensemble", "", "Comma-separated algorithms that vote on similarity instead of -algo, e.g. icon,dhash,phash")
+	flags.IntVar(&c.quorum, "quorum", 0, "With -ensemble, how many algorithms must agree; 0 means a majority")
+	flags.BoolVar(&c.matchTransforms, "match-transforms", false, "Also match rotated and mirrored copies")
+	return c
+}
+
+func (c *groupConfig) options() (SimilarityOptions, error) {
+	mode, err := parseGroupingMode(c.grouping)
+	if err != nil {
+		return SimilarityOptions{}, err
+	}
+	threshold, err := parseThreshold(c.threshold)
+	if err != nil {
+		return SimilarityOptions{}, err
+	}
+	algorithm, err := parseAlgorithmFlag(c.algorithm, c.matchTransforms)
+	if err != nil {
+		return SimilarityOptions{}, err
+	}
+	opts := SimilarityOptions{Grouping: mode, Threshold: threshold, Algorithm: algorithm, MatchTransforms: c.matchTransforms, FindCrops: c.findCrops}
+	if c.ensemble == "" {
+		if c.quorum != 0 {
+			return SimilarityOptions{}, errors.New("-quorum needs -ensemble")
+		}
+		return opts, nil
+	}
+	if algorithm != AlgoIcon {
+		return SimilarityOptions{}, errors.New("-ensemble and -algo cannot be combined")
+	}
+	if c.matchTransforms {
+		return SimilarityOptions{}, errors.New("-match-transforms only works with -algo icon")
+	}
+	if opts.Ensemble, opts.Quorum, err = parseEnsemble(c.ensemble, c.quorum); err != nil {
+		return SimilarityOptions{}, err
+	}
+	return opts, nil
+}
+
+// parseAlgorithmFlag parses -algo. Only icons can be rotated and mirrored
+// for -match-transforms.
+func parseAlgorithmFlag(s string, matchTransforms bool) (HashAlgorithm, error) {
+	algorithm, err := parseHashAlgorithm(s)
+	if err != nil {
+		return "", err
+	}
+	if matchTransforms && algorithm != AlgoIcon {
+		return "", errors.New("-match-transforms only works with -algo icon")
+	}
+	return algorithm, nil
+}
+
+// findGroups groups images and prints a summary.
+func findGroups(images []ImageInfo, opts SimilarityOptions) []DuplicateGroup {
+	fmt.Fprintln(statusOut, "Finding similar images...")
+	groups := findSimilarImages(images, opts)
+	fmt.Fprintf(statusOut, "Found %d groups of similar images (%s)\n", len(groups), summarizeKinds(groups))
+	return groups
+}
+
+// summarizeKinds counts groups by kind, e.g. "2 byte-identical, 1 visually
+// similar". Pixel-identical groups, RAW/JPEG pairs and crops are only
+// mentioned when there are some.
+func summarizeKinds(groups []DuplicateGroup) string {
+	counts := make(map[MatchKind]int)
+	for _, group := range groups {
+		counts[group.Kind]++
+	}
+	summary := fmt.Sprintf("%d byte-identical", counts[MatchIdentical])
+	if counts[MatchPixelIdentical] > 0 {
+		summary += fmt.Sprintf(", %d pixel-identical", counts[MatchPixelIdentical])
+	}
+	summary += fmt.Sprintf(", %d visually similar", counts[MatchPerceptual])
+	if counts[MatchRawPair] > 0 {
+		summary += fmt.Sprintf(", %d RAW/JPEG pairs", counts[MatchRawPair])
+	}
+	if counts[MatchCrop] > 0 {
+		summary += fmt.Sprintf(", %d of crops", counts[MatchCrop])
+	}
+	return summary
+}
+
+type reportConfig struct {
+	output            string
+	format            string
+	embedThumbnails   bool
+	thumbnailSize     int
+	thumbnailMaxBytes int
+	csvColumns        string
+
+	formats []OutputFormat
+	columns []string
+	ndjson  *ndjsonWriter
+}
+
+func addReportFlags(flags *flag.FlagSet) *reportConfig {
+	c := &reportConfig{}
+	flags.StringVar(&c.output, "output", "report.html", "Output file name; the extension follows each format, \"-\" writes to stdout")
+	flags.StringVar(&c.format, "format", string(FormatHTML), "Comma-separated output formats: html, json, ndjson, csv")
+	flags.BoolVar(&c.embedThumbnails, "embed-thumbnails", false, "Inline downscaled thumbnails in the HTML report so it is a single portable file")
+	flags.IntVar(&c.thumbnailSize, "thumbnail-size", defaultThumbnailSize, "Longest side of embedded thumbnails in pixels")
+	flags.IntVar(&c.thumbnailMaxBytes, "thumbnail-max-bytes", defaultThumbnailMaxBytes, "Size cap for each embedded thumbnail in bytes")
+	flags.StringVar(&c.csvColumns, "csv-columns", strings.Join(csvColumns, ","), "Comma-separated columns for the CSV output")
+	return c
+}
+
+// validate parses the format flags. Writing to stdout moves status messages
+// to stderr, so it must run before anything is printed.
+func (c *reportConfig) validate() error {
+	var err error
+	if c.formats, err = parseFormats(c.format); err != nil {
+		return err
+	}
+	if c.columns, err = parseCSVColumns(c.csvColumns); err != nil {
+		return err
+	}
+	if c.output == "-" {
+		if len(c.formats) > 1 {
+			return errors.New("only one output format can be written to stdout")
+		}
+		statusOut = os.Stderr
+	}
+	return nil
+}
+
+// startStreaming opens the NDJSON output, if selected, before grouping so
+// groups go out as they are found.
+func (c *reportConfig) startStreaming(opts *SimilarityOptions) error {
+	if !containsFormat(c.formats, FormatNDJSON) {
+		return nil
+	}
+	var err error
+	c.ndjson, err = newNDJSONWriter(outputPath(c.output, FormatNDJSON))
+	if err != nil {
+		return fmt.Errorf("creating NDJSON output: %w", err)
+	}
+	opts.OnGroup = c.ndjson.WriteGroup
+	return nil
+}
+
+// write finishes the streamed output and writes every other format,
+// reporting whether all of them succeeded.
+func (c *reportConfig) write(groups []DuplicateGroup) bool {
+	ok := true
+	if c.ndjson != nil {
+		if err := c.ndjson.Close(); err != nil {
+			fmt.Fprintf(statusOut, "Error writing NDJSON output: %v\n", err)
+			ok = false
+		} else {
+			fmt.Fprintf(statusOut, "NDJSON output written: %s\n", outputPath(c.output, FormatNDJSON))
+		}
+	}
+
+	if containsFormat(c.formats, FormatJSON) {
+		path := outputPath(c.output, FormatJSON)
+		if err := generateJSONReport(groups, path); err != nil {
+			fmt.Fprintf(statusOut, "Error generating JSON report: %v\n", err)
+			ok = false
+		} else {
+			fmt.Fprintf(statusOut, "JSON report generated: %s\n", path)
+		}
+	}
+
+	if containsFormat(c.formats, FormatCSV) {
+		path := outputPath(c.output, FormatCSV)
+		if err := generateCSVReport(groups, path, c.columns); err != nil {
+			fmt.Fprintf(statusOut, "Error generating CSV report: %v\n", err)
+			ok = false
+		} else {
+			fmt.Fprintf(statusOut, "CSV report generated: %s\n", path)
+		}
+	}
+
+	if containsFormat(c.formats, FormatHTML) {
+		path := outputPath(c.output, FormatHTML)
+		fmt.Fprintln(statusOut, "Generating HTML report...")
+		s := spinner.New(spinner.CharSets[9], 100*time.Millisecond, spinner.WithWriterFile(statusOut))
+		s.Start()
+		err := generateHTMLReport(groups, path, HTMLOptions{
+			EmbedThumbnails:   c.embedThumbnails,
+			ThumbnailSize:     c.thumbnailSize,
+			ThumbnailMaxBytes: c.thumbnailMaxBytes,
+			Opener:            RawImageOpener{Next: DefaultImageOpener{}},
+		})
+		s.Stop()
+		if err != nil {
+			fmt.Fprintf(statusOut, "Error generating HTML report: %v\n", err)
+			ok = false
+		} else {
+			fmt.Fprintf(statusOut, "HTML report generated: %s\n", path)
+		}
+	}
+	return ok
+}
+
+func containsFormat(formats []OutputFormat, format OutputFormat) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+type actionConfig struct {
+	quarantine string
+	link       string
+	keep       string
+	keepPrefix string
+	applyKinds string
+	journal    string
+	execute    bool
+
+	policy KeepPolicy
+	kinds  map[MatchKind]bool
+	linkOp JournalOp
+}
+
+func addActionFlags(flags *flag.FlagSet) *actionConfig {
+	c := &actionConfig{}
+	flags.StringVar(&c.quarantine, "quarantine", "", "Move every duplicate except the keeper of each group into this directory")
+	flags.StringVar(&c.link, "link", "", "Replace byte-identical duplicates with links to the keeper: hard, reflink or symlink")
+	flags.BoolVar(&c.execute, "execute", false, "Actually make the changes; without it they are only printed")
+	flags.StringVar(&c.keep, "keep", "resolution,size,oldest", "Comma-separated keep rules in priority order: resolution, size, oldest, shortest-path, prefix")
+	flags.StringVar(&c.keepPrefix, "keep-prefix", "", "Comma-separated directories to prefer, in priority order, for the prefix keep rule")
+	flags.StringVar(&c.journal, "journal", "", "Journal file recording every change for undo (default image-dupes-journal-<time>.jsonl)")
+	flags.StringVar(&c.applyKinds, "apply-kinds", "identical,pixel-identical,perceptual", "Comma-separated match kinds -quarantine acts on")
+	return c
+}
+
+func (c *actionConfig) validate() error {
+	var err error
+	if c.policy, err = parseKeepPolicy(c.keep, c.keepPrefix); err != nil {
+		return err
+	}
+	if c.kinds, err = parseMatchKinds(c.applyKinds); err != nil {
+		return err
+	}
+	if c.link != "" {
+		if c.quarantine != "" {
+			return errors.New("-quarantine and -link cannot be combined")
+		}
+		if c.linkOp, err = parseLinkMode(c.link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *actionConfig) requested() bool {
+	return c.quarantine != "" || c.linkOp != ""
+}
+
+// run plans the requested action on the groups found with opts and prints
+// it, or performs it with a journal when -execute is set. It reports
+// whether everything succeeded.
+func (c *actionConfig) run(groups []DuplicateGroup, root string, opts SimilarityOptions) bool {
+	var actions []Action
+	if c.linkOp != "" {
+		actions = planLinks(groups, c.policy, c.linkOp)
+	} else {
+		actions = planQuarantine(groups, ApplyOptions{
+			Policy:        c.policy,
+			QuarantineDir: c.quarantine,
+			Root:          root,
+			Kinds:         c.kinds,
+			Similarity:    &opts,
+		})
+	}
+	if !c.execute {
+		fmt.Fprintln(statusOut, "Dry run, nothing will be changed (add -execute to apply):")
+		executeActions(actions, true, statusOut, nil, nil)
+		fmt.Fprintf(statusOut, "Would change %d duplicates\n", len(actions))
+		return true
+	}
+
+	path := c.journal
+	if path == "" {
+		path = defaultJournalPath(time.Now())
+	}
+	journal, err := createJournal(path)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error creating journal, nothing was changed: %v\n", err)
+		return false
+	}
+	done, err := executeActions(actions, false, statusOut, journal, DefaultFileHasher{})
+	ok := err == nil
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error applying actions: %v\n", err)
+	}
+	if err := journal.Close(); err != nil {
+		fmt.Fprintf(statusOut, "Error closing journal: %v\n", err)
+		ok = false
+	}
+	fmt.Fprintf(statusOut, "Changed %d of %d duplicates\n", done, len(actions))
+	fmt.Fprintf(statusOut, "Journal written: %s (revert with: image-dupes undo %s)\n", path, path)
+	return ok
+}
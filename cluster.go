@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+type GroupingMode string
+
+const (
+	// GroupingAnchor groups every image with the unmatched images similar to
+	// it, in walk order. Membership depends on which image is seen first.
+	GroupingAnchor GroupingMode = "anchor"
+	// GroupingTransitive groups images connected by any chain of similar
+	// pairs, so if A~B and B~C then A, B and C share a group.
+	GroupingTransitive GroupingMode = "transitive"
+	// GroupingClique only groups images that are all similar to each other.
+	GroupingClique GroupingMode = "clique"
+)
+
+func parseGroupingMode(s string) (GroupingMode, error) {
+	switch mode := GroupingMode(s); mode {
+	case GroupingAnchor, GroupingTransitive, GroupingClique:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown grouping mode %q (want transitive, anchor or clique)", s)
+}
+
+type unionFind struct {
+	parent []int
+	rank   []int
+}
+
+func newUnionFind(n int) *unionFind {
+	uf := &unionFind{parent: make([]int, n), rank: make([]int, n)}
+	for i := range uf.parent {
+		uf.parent[i] = i
+	}
+	return uf
+}
+
+func (uf *unionFind) Find(x int) int {
+	for uf.parent[x] != x {
+		uf.parent[x] = uf.parent[uf.parent[x]]
+		x = uf.parent[x]
+	}
+	return x
+}
+
+func (uf *unionFind) Union(a, b int) {
+	ra, rb := uf.Find(a), uf.Find(b)
+	if ra == rb {
+		return
+	}
+	if uf.rank[ra] < uf.rank[rb] {
+		ra, rb = rb, ra
+	}
+	uf.parent[rb] = ra
+	if uf.rank[ra] == uf.rank[rb] {
+		uf.rank[ra]++
+	}
+}
+
+// clusterTransitive returns the connected components of the similarity graph
+// with more than one member. Members are sorted by path and groups by their
+// first path, so the result does not depend on input order.
+func clusterTransitive(imageInfos []ImageInfo, pairs [][2]int) [][]string {
+	uf := newUnionFind(len(imageInfos))
+	for _, pair := range pairs {
+		uf.Union(pair[0], pair[1])
+	}
+
+	components := make(map[int][]string)
+	for i, img := range imageInfos {
+		root := uf.Find(i)
+		components[root] = append(components[root], img.Path)
+	}
+
+	var groups [][]string
+	for _, paths := range components {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			groups = append(groups, paths)
+		}
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// clusterClique partitions the similarity graph into groups where every
+// member is similar to every other. Images are visited in path order and
+// each group greedily takes the remaining neighbours compatible with all of
+// its current members.
+func clusterClique(imageInfos []ImageInfo, pairs [][2]int) [][]string {
+	adjacent := make([]map[int]bool, len(imageInfos))
+	for i := range adjacent {
+		adjacent[i] = make(map[int]bool)
+	}
+	for _, pair := range pairs {
+		adjacent[pair[0]][pair[1]] = true
+		adjacent[pair[1]][pair[0]] = true
+	}
+
+	order := make([]int, len(imageInfos))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return imageInfos[order[a]].Path < imageInfos[order[b]].Path
+	})
+
+	rank := make([]int, len(imageInfos))
+	for r, i := range order {
+		rank[i] = r
+	}
+
+	assigned := make([]bool, len(imageInfos))
+	var groups [][]string
+	for _, i := range order {
+		if assigned[i] || len(adjacent[i]) == 0 {
+			continue
+		}
+
+		neighbors := make([]int, 0, len(adjacent[i]))
+		for j := range adjacent[i] {
+			neighbors = append(neighbors, j)
+		}
+		sort.Slice(neighbors, func(a, b int) bool {
+			return rank[neighbors[a]] < rank[neighbors[b]]
+		})
+
+		members := []int{i}
+		for _, j := range neighbors {
+			if assigned[j] {
+				continue
+			}
+			fits := true
+			for _, m := range members[1:] {
+				if !adjacent[m][j] {
+					fits = false
+					break
+				}
+			}
+			if fits {
+				members = append(members, j)
+			}
+		}
+
+		if len(members) > 1 {
+			group := make([]string, len(members))
+			for n, m := range members {
+				assigned[m] = true
+				group[n] = imageInfos[m].Path
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func sortGroups(groups [][]string) {
+	sort.Slice(groups, func(a, b int) bool {
+		return groups[a][0] < groups[b][0]
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"image"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// Helper function to build an icon with every pixel of every channel set to
+// the given raw value. Icons a few thousand apart are similar, twice that
+// apart they are not.
+func flatIcon(value uint16) images4.IconT {
+	pixels := make([]uint16, iconPixels*3)
+	for i := range pixels {
+		pixels[i] = value
+	}
+	return images4.IconT{Pixels: pixels, ImgSize: image.Point{X: 100, Y: 100}}
+}
+
+// A~B and B~C, but A and C are too far apart
+func chainImageInfos() []ImageInfo {
+	return []ImageInfo{
+		{Path: "/a.jpg", FileHash: [16]byte{1}, Icon: flatIcon(0)},
+		{Path: "/b.jpg", FileHash: [16]byte{2}, Icon: flatIcon(4000)},
+		{Path: "/c.jpg", FileHash: [16]byte{3}, Icon: flatIcon(8000)},
+	}
+}
+
+func TestChainFixture(t *testing.T) {
+	infos := chainImageInfos()
+	if !images4.Similar(infos[0].Icon, infos[1].Icon) || !images4.Similar(infos[1].Icon, infos[2].Icon) {
+		t.Fatalf("Expected neighbouring icons in the chain to be similar")
+	}
+	if images4.Similar(infos[0].Icon, infos[2].Icon) {
+		t.Fatalf("Expected the ends of the chain not to be similar")
+	}
+}
+
+func TestGroupingModesOnChain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mode     GroupingMode
+		order    []int
+		expected [][]string
+	}{
+		{"TransitiveForward", GroupingTransitive, []int{0, 1, 2}, [][]string{{"/a.jpg", "/b.jpg", "/c.jpg"}}},
+		{"TransitiveReverse", GroupingTransitive, []int{2, 1, 0}, [][]string{{"/a.jpg", "/b.jpg", "/c.jpg"}}},
+		{"TransitiveMiddleFirst", GroupingTransitive, []int{1, 2, 0}, [][]string{{"/a.jpg", "/b.jpg", "/c.jpg"}}},
+		{"CliqueForward", GroupingClique, []int{0, 1, 2}, [][]string{{"/a.jpg", "/b.jpg"}}},
+		{"CliqueReverse", GroupingClique, []int{2, 1, 0}, [][]string{{"/a.jpg", "/b.jpg"}}},
+		{"AnchorForward", GroupingAnchor, []int{0, 1, 2}, [][]string{{"/a.jpg", "/b.jpg"}}},
+		{"AnchorMiddleFirst", GroupingAnchor, []int{1, 2, 0}, [][]string{{"/b.jpg", "/c.jpg", "/a.jpg"}}},
+	}
+
+	chain := chainImageInfos()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var infos []ImageInfo
+			for _, i := range tc.order {
+				infos = append(infos, chain[i])
+			}
+
+			groups := groupByImageSimilarity(infos, SimilarityOptions{Grouping: tc.mode})
+			if !reflect.DeepEqual(groups, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, groups)
+			}
+		})
+	}
+}
+
+func TestGroupingIndependentOfOrder(t *testing.T) {
+	infos := syntheticImageInfos(150, 11)
+
+	for _, mode := range []GroupingMode{GroupingTransitive, GroupingClique} {
+		t.Run(string(mode), func(t *testing.T) {
+			want := groupByImageSimilarity(infos, SimilarityOptions{Grouping: mode})
+			if len(want) == 0 {
+				t.Fatalf("Corpus produced no groups")
+			}
+
+			shuffled := append([]ImageInfo(nil), infos...)
+			rand.New(rand.NewSource(5)).Shuffle(len(shuffled), func(i, j int) {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			})
+
+			got := groupByImageSimilarity(shuffled, SimilarityOptions{Grouping: mode})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Grouping changed with input order:\nwant %v\ngot  %v", want, got)
+			}
+		})
+	}
+}
+
+func TestCliqueGroupsAreFullyConnected(t *testing.T) {
+	infos := syntheticImageInfos(150, 13)
+	byPath := make(map[string]ImageInfo)
+	for _, img := range infos {
+		byPath[img.Path] = img
+	}
+
+	for _, group := range groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingClique}) {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				if !images4.Similar(byPath[group[i]].Icon, byPath[group[j]].Icon) {
+					t.Errorf("Clique group %v contains dissimilar pair %s, %s", group, group[i], group[j])
+				}
+			}
+		}
+	}
+}
+
+func TestUnionFind(t *testing.T) {
+	uf := newUnionFind(6)
+	uf.Union(0, 1)
+	uf.Union(2, 3)
+	uf.Union(1, 3)
+
+	if uf.Find(0) != uf.Find(2) {
+		t.Errorf("Expected 0 and 2 to be connected")
+	}
+	if uf.Find(4) == uf.Find(0) || uf.Find(4) == uf.Find(5) {
+		t.Errorf("Expected 4 to stay in its own set")
+	}
+
+	roots := make(map[int]bool)
+	for i := 0; i < 6; i++ {
+		roots[uf.Find(i)] = true
+	}
+	if len(roots) != 3 {
+		t.Errorf("Expected 3 sets, got %d", len(roots))
+	}
+}
+
+func TestParseGroupingMode(t *testing.T) {
+	for _, valid := range []string{"transitive", "anchor", "clique"} {
+		mode, err := parseGroupingMode(valid)
+		if err != nil || string(mode) != valid {
+			t.Errorf("parseGroupingMode(%q) = %q, %v", valid, mode, err)
+		}
+	}
+	if _, err := parseGroupingMode("greedy"); err == nil {
+		t.Errorf("Expected an error for an unknown grouping mode")
+	}
+}
+
+func TestClusterTransitiveSortsGroups(t *testing.T) {
+	infos := []ImageInfo{{Path: "/z"}, {Path: "/y"}, {Path: "/b"}, {Path: "/a"}, {Path: "/lonely"}}
+	groups := clusterTransitive(infos, [][2]int{{0, 1}, {2, 3}})
+
+	expected := [][]string{{"/a", "/b"}, {"/y", "/z"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Expected %v, got %v", expected, groups)
+	}
+	for _, group := range groups {
+		if !sort.StringsAreSorted(group) {
+			t.Errorf("Group members not sorted: %v", group)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runAll is the original one-shot pipeline: scan -dir, write the reports and
+// optionally act on the groups.
+func runAll(args []string) int {
+	flags := newFlagSet("all", "(-dir <directory>... | -files-from <file>) [flags]")
+	input := addInputFlags(flags)
+	scan := addScanFlags(flags)
+	grouping := addGroupFlags(flags)
+	report := addReportFlags(flags)
+	action := addActionFlags(flags)
+	flags.Parse(args)
+
+	if !input.given() {
+		return usageError(flags, errors.New("please specify a root directory using -dir or a file list using -files-from"))
+	}
+	opts, err := grouping.options()
+	if err != nil {
+		return usageError(flags, err)
+	}
+	if err := scan.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if err := report.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if err := action.validate(); err != nil {
+		return usageError(flags, err)
+	}
+
+	images, err := scan.scanInput(input)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	if err := report.startStreaming(&opts); err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	groups := findGroups(images, opts)
+	if !report.write(groups) {
+		return 1
+	}
+	var root string
+	if len(input.dirs) == 1 {
+		root = input.dirs[0]
+	}
+	if action.requested() && !action.run(groups, root, opts) {
+		return 1
+	}
+	return 0
+}
+
+func runScan(args []string) int {
+	flags := newFlagSet("scan", "scan (-dir <directory>... | -files-from <file>) [-index <file>] [flags]")
+	input := addInputFlags(flags)
+	indexPath := flags.String("index", defaultIndexPath, "Index file to write")
+	scan := addScanFlags(flags)
+	flags.Parse(args)
+
+	if !input.given() {
+		return usageError(flags, errors.New("please specify a root directory using -dir or a file list using -files-from"))
+	}
+	if err := scan.validate(); err != nil {
+		return usageError(flags, err)
+	}
+
+	paths, err := scan.findImages(input)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	// Absolute paths keep the index usable from any working directory
+	roots := make([]string, len(input.dirs))
+	for i, dir := range input.dirs {
+		roots[i] = absPath(dir)
+	}
+	for i, path := range paths {
+		paths[i] = absPath(path)
+	}
+	images, err := scan.scan(paths)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	index := ScanIndex{Roots: roots, Created: time.Now(), Images: images}
+	if err := saveIndex(*indexPath, index); err != nil {
+		fmt.Fprintf(statusOut, "Error writing index: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(statusOut, "Index written: %s\n", *indexPath)
+	return 0
+}
+
+func runReport(args []string) int {
+	flags := newFlagSet("report", "report (-index <file> | -dir <directory>... | -files-from <file>) [flags]")
+	source := addSourceFlags(flags)
+	grouping := addGroupFlags(flags)
+	report := addReportFlags(flags)
+	flags.Parse(args)
+
+	opts, err := grouping.options()
+	if err != nil {
+		return usageError(flags, err)
+	}
+	if err := source.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if err := report.validate(); err != nil {
+		return usageError(flags, err)
+	}
+
+	index, err := source.load()
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	if err := report.startStreaming(&opts); err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	groups := findGroups(index.Images, opts)
+	if !report.write(groups) {
+		return 1
+	}
+	return 0
+}
+
+func runApply(args []string) int {
+	flags := newFlagSet("apply", "apply (-index <file> | -dir <directory>... | -files-from <file>) (-quarantine <dir> | -link <mode>) [-execute] [flags]")
+	source := addSourceFlags(flags)
+	grouping := addGroupFlags(flags)
+	action := addActionFlags(flags)
+	flags.Parse(args)
+
+	opts, err := grouping.options()
+	if err != nil {
+		return usageError(flags, err)
+	}
+	if err := source.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if err := action.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if !action.requested() {
+		return usageError(flags, errors.New("please specify an action using -quarantine or -link"))
+	}
+
+	index, err := source.load()
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	groups := findGroups(index.Images, opts)
+
+	var root string
+	if len(index.Roots) == 1 {
+		root = index.Roots[0]
+	}
+	if !action.run(groups, root, opts) {
+		return 1
+	}
+	return 0
+}
+
+// runCompare reports which incoming images are already in a reference
+// archive, and lists or imports the rest.
+func runCompare(args []string) int {
+	flags := newFlagSet("compare", "compare (-ref <archive> | -ref-index <file>) -in <incoming> [flags]")
+	refDir := flags.String("ref", "", "Reference archive directory")
+	refIndex := flags.String("ref-index", "", "Index of the reference archive written by the scan command, instead of scanning -ref")
+	inDir := flags.String("in", "", "Directory of incoming images to check against the archive")
+	newList := flags.String("new-list", "", "Write the paths of incoming images not in the archive to this file, \"-\" for stdout")
+	copyNew := flags.Bool("copy-new", false, "Copy incoming images not in the archive into -ref, keeping their path relative to -in")
+	execute := flags.Bool("execute", false, "Actually copy with -copy-new; without it the copies are only printed")
+	scan := addScanFlags(flags)
+	report := addReportFlags(flags)
+	matching := addMatchFlags(flags)
+	flags.Parse(args)
+
+	if *inDir == "" {
+		return usageError(flags, errors.New("please specify the incoming directory using -in"))
+	}
+	if (*refDir == "") == (*refIndex == "") {
+		return usageError(flags, errors.New("please specify the archive using either -ref or -ref-index"))
+	}
+	if *copyNew && *refDir == "" {
+		return usageError(flags, errors.New("-copy-new needs the archive directory given with -ref"))
+	}
+	opts, err := matching.options()
+	if err != nil {
+		return usageError(flags, err)
+	}
+	if *newList == "-" && report.output == "-" {
+		return usageError(flags, errors.New("-new-list and -output cannot both write to stdout"))
+	}
+	if err := scan.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if err := report.validate(); err != nil {
+		return usageError(flags, err)
+	}
+	if *newList == "-" {
+		statusOut = os.Stderr
+	}
+
+	var ref []ImageInfo
+	if *refIndex != "" {
+		index, err := loadIndex(*refIndex)
+		if err != nil {
+			fmt.Fprintf(statusOut, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(statusOut, "Loaded %d archive images scanned %s from %s\n", len(index.Images), index.Created.Format(time.DateTime), *refIndex)
+		ref = index.Images
+	} else if ref, err = scan.scanInput(&inputConfig{dirs: stringList{*refDir}}); err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	incoming, err := scan.scanInput(&inputConfig{dirs: stringList{*inDir}})
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+
+	if err := report.startStreaming(&opts); err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(statusOut, "Comparing incoming images with the archive...")
+	result := compareWithReference(ref, incoming, opts)
+	fmt.Fprintf(statusOut, "%d of %d incoming images are already in the archive (%s); %d are new\n",
+		len(incoming)-len(result.New), len(incoming), summarizeKinds(result.Matches), len(result.New))
+	if result.Pairs > 0 {
+		fmt.Fprintf(statusOut, "%d of the new images are RAW files or JPEGs whose counterpart is in the archive\n", result.Pairs)
+	}
+
+	ok := report.write(result.Matches)
+	if *newList != "" {
+		if err := writeNewListFile(result.New, *newList); err != nil {
+			fmt.Fprintf(statusOut, "Error writing new file list: %v\n", err)
+			ok = false
+		} else if *newList != "-" {
+			fmt.Fprintf(statusOut, "New file list written: %s\n", *newList)
+		}
+	}
+	if *copyNew {
+		if !*execute {
+			fmt.Fprintln(statusOut, "Dry run, nothing will be copied (add -execute to copy):")
+		}
+		copied, err := importNew(result.New, *refDir, *inDir, !*execute, statusOut)
+		if err != nil {
+			fmt.Fprintf(statusOut, "Error copying new images: %v\n", err)
+			ok = false
+		}
+		if *execute {
+			fmt.Fprintf(statusOut, "Copied %d of %d new images into %s\n", copied, len(result.New), *refDir)
+		} else {
+			fmt.Fprintf(statusOut, "Would copy %d new images into %s\n", len(result.New), *refDir)
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+func runServe(args []string) int {
+	flags := newFlagSet("serve", "serve (-index <file> | -dir <directory>... | -files-from <file>) [-addr host:port] [flags]")
+	source := addSourceFlags(flags)
+	grouping := addGroupFlags(flags)
+	addr := flags.String("addr", "localhost:8080", "Address to listen on")
+	flags.Parse(args)
+
+	opts, err := grouping.options()
+	if err != nil {
+		return usageError(flags, err)
+	}
+	if err := source.validate(); err != nil {
+		return usageError(flags, err)
+	}
+
+	index, err := source.load()
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	groups := findGroups(index.Images, opts)
+
+	fmt.Fprintf(statusOut, "Serving the review UI on http://%s/ (Ctrl+C to stop)\n", *addr)
+	if err := serveReview(*addr, groups); err != nil {
+		fmt.Fprintf(statusOut, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runUndo implements "image-dupes undo <journal>" and returns the exit code.
+func runUndo(args []string) int {
+	flags := newFlagSet("undo", "undo <journal>")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return usageError(flags, errors.New("please specify the journal to undo"))
+	}
+
+	entries, err := readJournal(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error reading journal: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(statusOut, "Undoing %d operations from %s\n", len(entries), flags.Arg(0))
+	restored, err := undoJournal(entries, DefaultFileHasher{}, statusOut)
+	fmt.Fprintf(statusOut, "Restored %d files\n", restored)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Some files could not be restored:\n%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writePNG writes a w x h image whose pattern depends on seed.
+func writePNG(t *testing.T, path string, w, h, seed int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * seed), uint8(y * 3 * seed), uint8((x + y) * seed), 255})
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyTestFile(t *testing.T, src, dst string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSONReport(t *testing.T, path string) jsonReport {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestScanThenReport(t *testing.T) {
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+	writePNG(t, filepath.Join(photos, "a.png"), 64, 48, 1)
+	copyTestFile(t, filepath.Join(photos, "a.png"), filepath.Join(photos, "sub", "a copy.png"))
+	writePNG(t, filepath.Join(photos, "b.png"), 64, 48, 7)
+
+	indexPath := filepath.Join(dir, "photos.index")
+	if code := runScan([]string{"-dir", photos, "-index", indexPath, "-no-cache"}); code != 0 {
+		t.Fatalf("scan exited with %d", code)
+	}
+
+	// The index is enough to report, even after the scan root is renamed
+	if err := os.Rename(photos, photos+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "report.json")
+	if code := runReport([]string{"-index", indexPath, "-format", "json", "-output", output}); code != 0 {
+		t.Fatalf("report exited with %d", code)
+	}
+
+	report := readJSONReport(t, output)
+	if len(report.Groups) != 1 || report.Groups[0].Kind != MatchIdentical || len(report.Groups[0].Members) != 2 {
+		t.Errorf("Expected one identical pair, got %+v", report.Groups)
+	}
+}
+
+func TestCompareListsAndImportsNewImages(t *testing.T) {
+	dir := t.TempDir()
+	archive, incoming := filepath.Join(dir, "archive"), filepath.Join(dir, "incoming")
+	writePNG(t, filepath.Join(archive, "2023", "shared.png"), 64, 48, 1)
+	copyTestFile(t, filepath.Join(archive, "2023", "shared.png"), filepath.Join(archive, "2023", "shared copy.png"))
+	copyTestFile(t, filepath.Join(archive, "2023", "shared.png"), filepath.Join(incoming, "DCIM", "IMG_0001.png"))
+	writePNG(t, filepath.Join(incoming, "DCIM", "IMG_0002.png"), 64, 48, 7)
+
+	output := filepath.Join(dir, "compare.json")
+	newList := filepath.Join(dir, "new.txt")
+	args := []string{"-ref", archive, "-in", incoming, "-no-cache", "-format", "json", "-output", output,
+		"-new-list", newList, "-copy-new", "-execute"}
+	if code := runCompare(args); code != 0 {
+		t.Fatalf("compare exited with %d", code)
+	}
+
+	// The duplicate pair inside the archive is not reported
+	report := readJSONReport(t, output)
+	if len(report.Groups) != 1 || report.Groups[0].Kind != MatchIdentical || len(report.Groups[0].Members) != 3 {
+		t.Fatalf("Expected one match with both archive copies, got %+v", report.Groups)
+	}
+	if got := report.Groups[0].Members[0].Path; filepath.Base(got) != "IMG_0001.png" {
+		t.Errorf("Expected the incoming image first, got %s", got)
+	}
+
+	list, err := os.ReadFile(newList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(incoming, "DCIM", "IMG_0002.png") + "\n"; string(list) != want {
+		t.Errorf("New list = %q, want %q", list, want)
+	}
+	if _, err := os.Stat(filepath.Join(archive, "DCIM", "IMG_0002.png")); err != nil {
+		t.Errorf("New image was not imported: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archive, "DCIM", "IMG_0001.png")); !os.IsNotExist(err) {
+		t.Errorf("Known image should not be imported, got %v", err)
+	}
+}
+
+func TestScanMultipleRootsAndFileList(t *testing.T) {
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+	writePNG(t, filepath.Join(photos, "a.png"), 64, 48, 1)
+	writePNG(t, filepath.Join(photos, "2023", "b.png"), 64, 48, 7)
+	writePNG(t, filepath.Join(dir, "loose", "c.png"), 64, 48, 13)
+	writePNG(t, filepath.Join(dir, "loose", "d.png"), 64, 48, 19)
+
+	list := filepath.Join(dir, "list")
+	listed := filepath.Join(dir, "loose", "c.png") + "\x00" + filepath.Join(photos, "a.png") + "\x00" + filepath.Join(dir, "notes.txt") + "\x00"
+	if err := os.WriteFile(list, []byte(listed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlapping root and the list repeat photos, which is scanned once
+	indexPath := filepath.Join(dir, "photos.index")
+	args := []string{"-dir", photos, "-dir", filepath.Join(photos, "2023"), "-files-from", list, "-index", indexPath, "-no-cache"}
+	if code := runScan(args); code != 0 {
+		t.Fatalf("scan exited with %d", code)
+	}
+
+	index, err := loadIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, img := range index.Images {
+		got = append(got, img.Path)
+	}
+	want := []string{
+		filepath.Join(photos, "2023", "b.png"),
+		filepath.Join(photos, "a.png"),
+		filepath.Join(dir, "loose", "c.png"),
+	}
+	if !reflect.DeepEqual(sortStrings(got), sortStrings(want)) {
+		t.Errorf("Indexed %v, want %v", got, want)
+	}
+	if len(index.Roots) != 2 {
+		t.Errorf("Expected both roots in the index, got %v", index.Roots)
+	}
+}
+
+func TestUsageErrorWritesToFlagOutput(t *testing.T) {
+	flags := newFlagSet("report", "report [flags]")
+	var out bytes.Buffer
+	flags.SetOutput(&out)
+	if code := usageError(flags, errors.New("bad -format")); code != 2 {
+		t.Errorf("Expected exit code 2, got %d", code)
+	}
+	if !strings.HasPrefix(out.String(), "bad -format\nUsage: image-dupes report [flags]") {
+		t.Errorf("Expected the error followed by the usage, got %q", out.String())
+	}
+}
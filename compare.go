@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CompareResult splits an incoming set of images into those already in the
+// reference set and those that are new.
+type CompareResult struct {
+	// Matches holds one group per incoming image found in the reference
+	// set: the incoming image first, then its reference matches.
+	Matches []DuplicateGroup
+	New     []ImageInfo
+	// Pairs counts the new images that are only matched by their RAW or
+	// JPEG counterpart; they are in both Matches and New.
+	Pairs int
+}
+
+// compareWithReference matches every incoming image against the reference
+// set. Images are never compared within the reference set, nor within the
+// incoming one. A byte-identical match takes precedence, then a
+// pixel-identical one; otherwise every similar reference image is listed,
+// closest first. A RAW file only matched by JPEGs, or the other way round,
+// is still new: the archive holds its counterpart, not the file itself.
+func compareWithReference(ref, incoming []ImageInfo, opts SimilarityOptions) CompareResult {
+	var result CompareResult
+	byHash := groupByFileHash(ref)
+	byPixels := groupByPixelHash(ref)
+
+	all := make([]ImageInfo, 0, len(ref)+len(incoming))
+	all = append(all, ref...)
+	all = append(all, incoming...)
+	index := newSimilarityIndex(all, opts)
+
+	for n, img := range incoming {
+		if same := byHash[img.FileHash]; len(same) > 0 {
+			group := append([]ImageInfo{img}, same...)
+			result.Matches = opts.emit(result.Matches, newDuplicateGroup(MatchIdentical, group))
+		} else if same := byPixels[img.PixelHash]; len(same) > 0 && !isRawFile(img.Path) {
+			group := append([]ImageInfo{img}, same...)
+			result.Matches = opts.emit(result.Matches, newDuplicateGroup(MatchPixelIdentical, group))
+		} else if similar := similarReferences(index, len(ref), len(ref)+n); len(similar) > 0 {
+			group := append([]ImageInfo{img}, similar...)
+			result.Matches = opts.emit(result.Matches, opts.perceptualGroup(group))
+			if onlyCounterparts(img, similar) {
+				result.New = append(result.New, img)
+				result.Pairs++
+			}
+		} else {
+			result.New = append(result.New, img)
+		}
+
+		if (n+1)%100 == 0 || n+1 == len(incoming) {
+			fmt.Fprintf(statusOut, "\rImage comparison progress: %d/%d", n+1, len(incoming))
+		}
+	}
+	fmt.Fprintln(statusOut) // New line after progress
+	return result
+}
+
+// similarReferences returns the images among the first numRef indexed that
+// are similar to image i, closest first.
+func similarReferences(index *similarityIndex, numRef, i int) []ImageInfo {
+	refs := index.similar(i, 0, numRef)
+	sort.SliceStable(refs, func(a, b int) bool {
+		return index.distance(i, refs[a]) < index.distance(i, refs[b])
+	})
+	similar := make([]ImageInfo, len(refs))
+	for n, j := range refs {
+		similar[n] = index.images[j]
+	}
+	return similar
+}
+
+// onlyCounterparts reports whether every similar image is a RAW file when
+// img is not, or the other way round.
+func onlyCounterparts(img ImageInfo, similar []ImageInfo) bool {
+	for _, other := range similar {
+		if isRawFile(other.Path) == isRawFile(img.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeNewList writes the path of every new image, one per line.
+func writeNewList(images []ImageInfo, w io.Writer) error {
+	for _, img := range images {
+		if _, err := fmt.Fprintln(w, img.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNewListFile writes the new image list to path, "-" meaning stdout.
+func writeNewListFile(images []ImageInfo, path string) error {
+	if path == "-" {
+		return writeNewList(images, os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeNewList(images, file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// importNew copies every new image into the archive, mirroring its path
+// relative to the incoming root. Existing files are never overwritten. It
+// returns how many files were copied (0 on a dry run).
+func importNew(images []ImageInfo, archive, incomingRoot string, dryRun bool, out io.Writer) (int, error) {
+	copied := 0
+	for _, img := range images {
+		target := quarantinePath(archive, incomingRoot, img.Path)
+		if dryRun {
+			fmt.Fprintf(out, "  would copy %s -> %s\n", img.Path, target)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return copied, err
+		}
+		if err := copyFile(img.Path, target); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				err = fmt.Errorf("%s already exists", target)
+			} else {
+				os.Remove(target)
+			}
+			return copied, fmt.Errorf("copy %s: %w", img.Path, err)
+		}
+		copied++
+		fmt.Fprintf(out, "  copied %s -> %s\n", img.Path, target)
+	}
+	return copied, nil
+}
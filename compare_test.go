@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"reflect"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+func TestCompareWithReferenceMatchesBruteForce(t *testing.T) {
+	corpus := syntheticImageInfos(200, 3)
+	ref, incoming := corpus[:120], corpus[120:]
+	// An incoming byte-identical copy of an archive image
+	incoming = append(incoming, ImageInfo{Path: "/incoming/copy.jpg", FileHash: ref[0].FileHash, Icon: ref[0].Icon})
+
+	result := compareWithReference(ref, incoming, SimilarityOptions{})
+
+	matched := make(map[string][]string)
+	for i, group := range result.Matches {
+		if group.ID != i+1 {
+			t.Errorf("Group %d has ID %d", i, group.ID)
+		}
+		matched[group.Members[0].Path] = group.Paths()[1:]
+		for _, member := range group.Members[1:] {
+			if member.Score < group.Members[1].Score {
+				t.Errorf("Matches of %s are not sorted closest first", group.Members[0].Path)
+			}
+		}
+	}
+	if got := matched["/incoming/copy.jpg"]; len(got) != 1 || got[0] != ref[0].Path {
+		t.Errorf("Expected the copy to match only %s, got %v", ref[0].Path, got)
+	}
+
+	for _, img := range incoming[:len(incoming)-1] {
+		var want []string
+		for _, r := range ref {
+			if images4.Similar(img.Icon, r.Icon) {
+				want = append(want, r.Path)
+			}
+		}
+		if got := matched[img.Path]; len(got) != len(want) {
+			t.Errorf("%s: matched %v, want %v", img.Path, got, want)
+		}
+	}
+	if len(result.Matches)+len(result.New) != len(incoming) {
+		t.Errorf("%d matches and %d new images for %d incoming", len(result.Matches), len(result.New), len(incoming))
+	}
+}
+
+func TestCompareWithReferenceIgnoresDuplicatesWithinASet(t *testing.T) {
+	a, b := syntheticImageInfos(1, 5)[0], syntheticImageInfos(1, 11)[0]
+	b.Path, b.FileHash = "/incoming/b.jpg", md5.Sum([]byte("/incoming/b.jpg"))
+	if images4.Similar(a.Icon, b.Icon) {
+		t.Fatal("Test images should not be similar")
+	}
+	aCopy := ImageInfo{Path: "/ref/a copy.jpg", FileHash: a.FileHash, Icon: a.Icon}
+	bCopy := ImageInfo{Path: "/incoming/b copy.jpg", FileHash: b.FileHash, Icon: b.Icon}
+
+	result := compareWithReference([]ImageInfo{a, aCopy}, []ImageInfo{b, bCopy}, SimilarityOptions{})
+	if len(result.Matches) != 0 || len(result.New) != 2 {
+		t.Errorf("Expected both incoming images to be new, got %d matches and %d new", len(result.Matches), len(result.New))
+	}
+}
+
+func TestCompareWithReferencePixelIdentical(t *testing.T) {
+	a := syntheticImageInfos(1, 5)[0]
+	a.PixelHash = [16]byte{3}
+	retagged := ImageInfo{Path: "/incoming/a.jpg", FileHash: md5.Sum([]byte("/incoming/a.jpg")), PixelHash: a.PixelHash, Icon: a.Icon}
+
+	result := compareWithReference([]ImageInfo{a}, []ImageInfo{retagged}, SimilarityOptions{})
+	if len(result.Matches) != 1 || result.Matches[0].Kind != MatchPixelIdentical {
+		t.Fatalf("Expected one pixel-identical match, got %v", result.Matches)
+	}
+	if paths := result.Matches[0].Paths(); !reflect.DeepEqual(paths, []string{retagged.Path, a.Path}) {
+		t.Errorf("Expected the incoming image matched with %s, got %v", a.Path, paths)
+	}
+}
+
+func TestCompareWithReferenceKeepsRawCounterpartsNew(t *testing.T) {
+	base := syntheticImageInfos(1, 5)[0]
+	info := func(path string) ImageInfo {
+		return ImageInfo{Path: path, FileHash: md5.Sum([]byte(path)), Icon: base.Icon}
+	}
+
+	testCases := []struct {
+		name     string
+		ref      []ImageInfo
+		incoming ImageInfo
+		wantNew  bool
+	}{
+		{"RawOfArchivedJPEG", []ImageInfo{info("/ref/sample.jpg")}, info("/in/sample.dng"), true},
+		{"JPEGOfArchivedRaw", []ImageInfo{info("/ref/sample.dng")}, info("/in/sample.jpg"), true},
+		{"RawAlsoArchived", []ImageInfo{info("/ref/sample.jpg"), info("/ref/sample.dng")}, info("/in/sample.dng"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := compareWithReference(tc.ref, []ImageInfo{tc.incoming}, SimilarityOptions{})
+			if len(result.Matches) != 1 {
+				t.Fatalf("Expected the counterpart to be reported, got %v", result.Matches)
+			}
+			if isNew := len(result.New) == 1; isNew != tc.wantNew {
+				t.Errorf("Expected new %v, got new images %v", tc.wantNew, result.New)
+			}
+			if wantPairs := len(result.New); result.Pairs != wantPairs {
+				t.Errorf("Expected %d pairs, got %d", wantPairs, result.Pairs)
+			}
+		})
+	}
+}
+
+func TestCompareWithReferenceEnsemble(t *testing.T) {
+	ref := []ImageInfo{hashedInfo("/ref/a.jpg", 0, 0, 0)}
+	// ahash and phash agree, dhash does not
+	incoming := []ImageInfo{hashedInfo("/in/b.jpg", 0, 0xfff, 1)}
+	algorithms := []HashAlgorithm{AlgoAverage, AlgoDifference, AlgoPerception}
+
+	result := compareWithReference(ref, incoming, SimilarityOptions{Ensemble: algorithms, Quorum: 2})
+	if len(result.Matches) != 1 || len(result.New) != 0 {
+		t.Fatalf("Expected the incoming image to match by a majority, got %v and new %v", result.Matches, result.New)
+	}
+	if member := result.Matches[0].Members[1]; member.Distances[AlgoDifference] != 12.0/11 {
+		t.Errorf("Expected the dissenting dhash distance to be reported, got %v", member.Distances)
+	}
+
+	result = compareWithReference(ref, incoming, SimilarityOptions{Ensemble: algorithms, Quorum: 3})
+	if len(result.Matches) != 0 || len(result.New) != 1 {
+		t.Errorf("Expected the incoming image to be new when every algorithm must agree, got %v", result.Matches)
+	}
+}
+
+func TestWriteNewList(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeNewList([]ImageInfo{{Path: "/in/a.jpg"}, {Path: "/in/b c.jpg"}}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/in/a.jpg\n/in/b c.jpg\n"; buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"sort"
+)
+
+// LumaThumb is a small grayscale copy of an image that keeps its aspect
+// ratio. Unlike the square images4 icon, any region of it can be compared
+// with another image, which is how crops are found.
+type LumaThumb struct {
+	Width  int
+	Height int
+	Pix    []uint8
+}
+
+const (
+	// thumbSize is the longest side of a LumaThumb
+	thumbSize = 64
+	// thumbSamples² points are averaged into every thumbnail pixel
+	thumbSamples = 4
+)
+
+// Crop search parameters
+const (
+	coarseGrid = 4
+	fineGrid   = 12
+	// minCropSide is the smallest crop found, as a fraction of the width
+	// and height of the image it was cut from
+	minCropSide = 0.4
+	// maxCropArea is the largest crop, as a fraction of the area; larger
+	// regions are near-duplicates rather than crops
+	maxCropArea   = 0.9
+	cropScaleStep = 1.1
+	// cropAspectStep is the log aspect ratio difference below which crops
+	// share their coarse windows
+	cropAspectStep = 0.02
+	// minCropCorrelation is the correlation between a crop and its region
+	// needed at the default threshold
+	minCropCorrelation = 0.99
+	// minCoarseCorrelation is needed before a region is refined
+	minCoarseCorrelation = 0.85
+	// minCropContrast is the luma standard deviation below which a region
+	// is too flat to match anything
+	minCropContrast = 2.0
+	// maxCropToneShift and maxCropContrastRatio bound how much brighter or
+	// more contrasted a crop may be than its region
+	maxCropToneShift     = 16.0
+	maxCropContrastRatio = 1.25
+	// minRefineCorrelation is needed at full detail, before the region is
+	// moved into place, for it to be refined
+	minRefineCorrelation = 0.7
+	// coarseCandidates is how many of the best coarse regions are refined
+	coarseCandidates = 2
+)
+
+func newLumaThumb(img image.Image) LumaThumb {
+	b := img.Bounds()
+	if b.Empty() {
+		return LumaThumb{}
+	}
+	w, h := thumbSize, thumbSize
+	if b.Dx() >= b.Dy() {
+		h = max(1, int(math.Round(float64(thumbSize*b.Dy())/float64(b.Dx()))))
+	} else {
+		w = max(1, int(math.Round(float64(thumbSize*b.Dx())/float64(b.Dy()))))
+	}
+
+	// Sampling a few points per pixel reads far less than the whole image
+	thumb := LumaThumb{Width: w, Height: h, Pix: make([]uint8, w*h)}
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w; tx++ {
+			sum := 0
+			for sy := 0; sy < thumbSamples; sy++ {
+				y := b.Min.Y + int((float64(ty)+(float64(sy)+0.5)/thumbSamples)*float64(b.Dy())/float64(h))
+				for sx := 0; sx < thumbSamples; sx++ {
+					x := b.Min.X + int((float64(tx)+(float64(sx)+0.5)/thumbSamples)*float64(b.Dx())/float64(w))
+					sum += int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				}
+			}
+			thumb.Pix[ty*w+tx] = uint8(sum / (thumbSamples * thumbSamples))
+		}
+	}
+	return thumb
+}
+
+// image returns the thumbnail as a grayscale image, or nil if it is empty.
+func (t LumaThumb) image() *image.Gray {
+	if t.Width == 0 || t.Height == 0 || len(t.Pix) < t.Width*t.Height {
+		return nil
+	}
+	return &image.Gray{Pix: t.Pix, Stride: t.Width, Rect: image.Rect(0, 0, t.Width, t.Height)}
+}
+
+// cropRegion is a region of an image, in fractions of its width and height.
+type cropRegion struct {
+	x, y, w, h float64
+}
+
+// cropImage holds what the crop search needs about one image.
+type cropImage struct {
+	info ImageInfo
+	// aspect is height over width
+	aspect float64
+	// sat is the summed-area table of the thumbnail, with an extra leading
+	// row and column of zeros
+	sat    []float64
+	coarse []float64
+	fine   []float64
+	// mean and contrast are the luma mean and standard deviation
+	mean     float64
+	contrast float64
+}
+
+func newCropImage(info ImageInfo) *cropImage {
+	t := info.Thumb
+	if t.image() == nil {
+		return nil
+	}
+	c := &cropImage{info: info, aspect: float64(t.Height) / float64(t.Width)}
+	if size := info.Icon.ImgSize; size.X > 0 && size.Y > 0 {
+		c.aspect = float64(size.Y) / float64(size.X)
+	}
+
+	stride := t.Width + 1
+	c.sat = make([]float64, stride*(t.Height+1))
+	for y := 0; y < t.Height; y++ {
+		row := 0.0
+		for x := 0; x < t.Width; x++ {
+			row += float64(t.Pix[y*t.Width+x])
+			c.sat[(y+1)*stride+x+1] = c.sat[y*stride+x+1] + row
+		}
+	}
+
+	whole := cropRegion{0, 0, 1, 1}
+	c.coarse, _, _ = c.signature(whole, coarseGrid)
+	c.fine, c.mean, c.contrast = c.signature(whole, fineGrid)
+	if c.coarse == nil || c.fine == nil {
+		return nil
+	}
+	return c
+}
+
+// integral returns the sum of the thumbnail over [0, x) × [0, y), for x and
+// y in thumbnail pixels. Interpolating the table bilinearly is exact for an
+// image made of constant pixels.
+func (c *cropImage) integral(x, y float64) float64 {
+	t := c.info.Thumb
+	x = math.Max(0, math.Min(x, float64(t.Width)))
+	y = math.Max(0, math.Min(y, float64(t.Height)))
+	x0, y0 := min(int(x), t.Width-1), min(int(y), t.Height-1)
+	fx, fy := x-float64(x0), y-float64(y0)
+	stride := t.Width + 1
+	at := func(x, y int) float64 { return c.sat[y*stride+x] }
+	top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+	bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// signature averages the region over a grid×grid grid and normalizes the
+// result to zero mean and unit length, so the dot product of two
+// signatures is their correlation. It also returns the mean and standard
+// deviation it took out. Flat regions return a nil signature.
+func (c *cropImage) signature(r cropRegion, grid int) (sig []float64, mean, contrast float64) {
+	t := c.info.Thumb
+	x0, y0 := r.x*float64(t.Width), r.y*float64(t.Height)
+	cw, ch := r.w*float64(t.Width)/float64(grid), r.h*float64(t.Height)/float64(grid)
+
+	// Integrate at every grid line crossing once, then take differences
+	corners := make([]float64, (grid+1)*(grid+1))
+	for gy := 0; gy <= grid; gy++ {
+		for gx := 0; gx <= grid; gx++ {
+			corners[gy*(grid+1)+gx] = c.integral(x0+float64(gx)*cw, y0+float64(gy)*ch)
+		}
+	}
+	sig = make([]float64, grid*grid)
+	for gy := 0; gy < grid; gy++ {
+		for gx := 0; gx < grid; gx++ {
+			at := func(dx, dy int) float64 { return corners[(gy+dy)*(grid+1)+gx+dx] }
+			sig[gy*grid+gx] = (at(1, 1) - at(0, 1) - at(1, 0) + at(0, 0)) / (cw * ch)
+			mean += sig[gy*grid+gx]
+		}
+	}
+	mean /= float64(len(sig))
+
+	norm := 0.0
+	for i := range sig {
+		sig[i] -= mean
+		norm += sig[i] * sig[i]
+	}
+	norm = math.Sqrt(norm)
+	contrast = norm / math.Sqrt(float64(len(sig)))
+	if contrast < minCropContrast {
+		return nil, mean, contrast
+	}
+	for i := range sig {
+		sig[i] /= norm
+	}
+	return sig, mean, contrast
+}
+
+// correlation compares a region of c with the whole of other.
+func (c *cropImage) correlation(r cropRegion, other []float64, grid int) float64 {
+	sig, _, _ := c.signature(r, grid)
+	if sig == nil || other == nil {
+		return -1
+	}
+	return dot(sig, other)
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+type scoredRegion struct {
+	cropRegion
+	correlation float64
+}
+
+// cropWindow is a region searched in the coarse pass, with its signature.
+type cropWindow struct {
+	cropRegion
+	sig []float64
+}
+
+// coarseWindows lists the regions of c, at every scale and position, that
+// have the given aspect ratio and are neither too small nor too large to
+// be a crop.
+func (c *cropImage) coarseWindows(aspect float64) []cropWindow {
+	// A region of c with this aspect ratio, fw wide, is fw*ratio tall
+	ratio := aspect / c.aspect
+
+	var windows []cropWindow
+	for fw := 1.0; fw >= minCropSide; fw /= cropScaleStep {
+		fh := fw * ratio
+		if fh > 1 {
+			continue
+		}
+		if fh < minCropSide {
+			break
+		}
+		if fw*fh > maxCropArea {
+			continue
+		}
+		// Step by one coarse cell, ending flush with the far edge
+		nx, ny := int(math.Ceil((1-fw)*coarseGrid/fw)), int(math.Ceil((1-fh)*coarseGrid/fh))
+		for iy := 0; iy <= ny; iy++ {
+			for ix := 0; ix <= nx; ix++ {
+				r := cropRegion{w: fw, h: fh}
+				if nx > 0 {
+					r.x = (1 - fw) * float64(ix) / float64(nx)
+				}
+				if ny > 0 {
+					r.y = (1 - fh) * float64(iy) / float64(ny)
+				}
+				if sig, _, _ := c.signature(r, coarseGrid); sig != nil {
+					windows = append(windows, cropWindow{r, sig})
+				}
+			}
+		}
+	}
+	return windows
+}
+
+// findCrop looks for crop among the coarse windows of c, computed for an
+// aspect ratio close to that of crop, and refines the best ones. It returns
+// the region and its distance, below threshold for a match.
+func (c *cropImage) findCrop(crop *cropImage, windows []cropWindow, threshold float64) (cropRegion, float64, bool) {
+	var best []scoredRegion
+	for _, window := range windows {
+		if corr := dot(window.sig, crop.coarse); corr >= minCoarseCorrelation {
+			best = append(best, scoredRegion{window.cropRegion, corr})
+		}
+	}
+	if len(best) == 0 {
+		return cropRegion{}, 0, false
+	}
+	sort.Slice(best, func(i, j int) bool { return best[i].correlation > best[j].correlation })
+	if len(best) > coarseCandidates {
+		best = best[:coarseCandidates]
+	}
+
+	ratio := crop.aspect / c.aspect
+	var found scoredRegion
+	found.correlation = -1
+	for _, candidate := range best {
+		if refined := c.refineCrop(candidate.cropRegion, crop, ratio); refined.correlation > found.correlation {
+			found = refined
+		}
+	}
+	if found.correlation < 0 {
+		return cropRegion{}, 0, false
+	}
+
+	// Correlation ignores brightness and contrast, which a crop keeps
+	if _, mean, contrast := c.signature(found.cropRegion, fineGrid); math.Abs(mean-crop.mean) > maxCropToneShift ||
+		math.Abs(math.Log(contrast/crop.contrast)) > math.Log(maxCropContrastRatio) {
+		return cropRegion{}, 0, false
+	}
+
+	// An image that matches as a whole is a duplicate, not a crop
+	if math.Abs(ratio-1) < defaultProportionThreshold && c.correlation(cropRegion{0, 0, 1, 1}, crop.fine, fineGrid) >= found.correlation {
+		return cropRegion{}, 0, false
+	}
+	distance := (1 - found.correlation) / (1 - minCropCorrelation)
+	return found.cropRegion, distance, distance < threshold
+}
+
+// refineCrop improves a coarse region by moving and scaling it in ever
+// smaller steps while the fine correlation increases.
+func (c *cropImage) refineCrop(r cropRegion, crop *cropImage, ratio float64) scoredRegion {
+	best := scoredRegion{r, c.correlation(r, crop.fine, fineGrid)}
+	if best.correlation < minRefineCorrelation {
+		return best
+	}
+	valid := func(r cropRegion) bool {
+		return r.w >= minCropSide && r.h >= minCropSide && r.w*r.h <= maxCropArea &&
+			r.x >= 0 && r.y >= 0 && r.x+r.w <= 1 && r.y+r.h <= 1
+	}
+
+	// Start at half a coarse cell and stop below a quarter thumbnail pixel
+	step := 0.5 / coarseGrid
+	for step*r.w*thumbSize >= 0.25 {
+		improved := false
+		for _, move := range [][3]float64{{-1, 0, 0}, {1, 0, 0}, {0, -1, 0}, {0, 1, 0}, {0, 0, -1}, {0, 0, 1}} {
+			next := best.cropRegion
+			next.x += move[0] * step * next.w
+			next.y += move[1] * step * next.h
+			if move[2] != 0 {
+				// Scale about the centre
+				w := next.w * (1 + move[2]*step)
+				next.x -= (w - next.w) / 2
+				next.y -= (w*ratio - next.h) / 2
+				next.w, next.h = w, w*ratio
+			}
+			if !valid(next) {
+				continue
+			}
+			if corr := c.correlation(next, crop.fine, fineGrid); corr > best.correlation {
+				best = scoredRegion{next, corr}
+				improved = true
+			}
+		}
+		if !improved {
+			step /= 2
+		}
+	}
+	return best
+}
+
+// cropMatch records that an image is a crop of another.
+type cropMatch struct {
+	of       int
+	region   cropRegion
+	distance float64
+}
+
+// findCropGroups groups every image with the images found to be crops of
+// it, or of which it is a padded copy. Like anchor grouping, the largest
+// images are taken first, and an image is only put in one group.
+func findCropGroups(imageInfos []ImageInfo, threshold float64) []DuplicateGroup {
+	images := make([]*cropImage, len(imageInfos))
+	for i, info := range imageInfos {
+		images[i] = newCropImage(info)
+	}
+
+	// Crops are searched for in every image, spread over all CPUs. Each
+	// image's regions are computed once for every aspect ratio among the
+	// crops.
+	byAspect := make(map[int][]int)
+	for i, img := range images {
+		if img != nil {
+			key := int(math.Round(math.Log(img.aspect) / cropAspectStep))
+			byAspect[key] = append(byAspect[key], i)
+		}
+	}
+	found := make([][]cropMatch, len(images)) // found[j] lists the crops of image j
+	jobs := make(chan int)
+	done := make(chan struct{})
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		go func() {
+			for j := range jobs {
+				if images[j] != nil {
+					found[j] = cropsIn(images, j, byAspect, threshold)
+				}
+				done <- struct{}{}
+			}
+		}()
+	}
+	go func() {
+		for j := range images {
+			jobs <- j
+		}
+		close(jobs)
+	}()
+	for n := 1; n <= len(images); n++ {
+		<-done
+		if n%100 == 0 || n == len(images) {
+			fmt.Fprintf(statusOut, "\rCrop detection progress: %d/%d", n, len(images))
+		}
+	}
+	fmt.Fprintln(statusOut) // New line after progress
+
+	order := make([]int, len(images))
+	for i := range order {
+		order[i] = i
+	}
+	pixels := func(i int) int { return imageInfos[i].Icon.ImgSize.X * imageInfos[i].Icon.ImgSize.Y }
+	sort.SliceStable(order, func(a, b int) bool { return pixels(order[a]) > pixels(order[b]) })
+	rank := make([]int, len(images))
+	for r, i := range order {
+		rank[i] = r
+	}
+
+	// Only images with crops can start a group, so this is linear in the
+	// number of crops found
+	var groups []DuplicateGroup
+	grouped := make([]bool, len(images))
+	for _, i := range order {
+		if grouped[i] || len(found[i]) == 0 {
+			continue
+		}
+		members := []cropMatch{{of: i}}
+		for _, m := range found[i] {
+			if !grouped[m.of] {
+				members = append(members, m)
+			}
+		}
+		if len(members) > 1 {
+			sort.SliceStable(members[1:], func(a, b int) bool { return rank[members[1+a].of] < rank[members[1+b].of] })
+			for _, m := range members {
+				grouped[m.of] = true
+			}
+			groups = append(groups, newCropGroup(imageInfos, members))
+		}
+	}
+	return groups
+}
+
+// cropsIn returns the images that are crops of images[j]; their of field
+// is the crop's index. A crop, even scaled down, is no wider or taller in
+// pixels than the image it was cut from, so larger images are skipped
+// without a search.
+func cropsIn(images []*cropImage, j int, byAspect map[int][]int, threshold float64) []cropMatch {
+	container := images[j]
+	size := container.info.Icon.ImgSize
+	var crops []cropMatch
+	for _, indices := range byAspect {
+		var windows []cropWindow
+		for _, i := range indices {
+			if crop := images[i].info.Icon.ImgSize; i == j || crop.X > size.X || crop.Y > size.Y {
+				continue
+			}
+			if windows == nil {
+				windows = container.coarseWindows(images[indices[0]].aspect)
+			}
+			if region, distance, ok := container.findCrop(images[i], windows, threshold); ok {
+				crops = append(crops, cropMatch{of: i, region: region, distance: distance})
+			}
+		}
+	}
+	return crops
+}
+
+// newCropGroup builds a group of crops, the image they were cut from first.
+// members[0] is that image; the others record their region in it.
+func newCropGroup(imageInfos []ImageInfo, members []cropMatch) DuplicateGroup {
+	images := make([]ImageInfo, len(members))
+	for i, m := range members {
+		images[i] = imageInfos[m.of]
+	}
+	group := newDuplicateGroup(MatchCrop, images)
+	size := images[0].Icon.ImgSize
+	for i := 1; i < len(members); i++ {
+		r := members[i].region
+		group.Members[i].Score = members[i].distance
+		group.Members[i].Region = image.Rect(
+			int(math.Round(r.x*float64(size.X))), int(math.Round(r.y*float64(size.Y))),
+			int(math.Round((r.x+r.w)*float64(size.X))), int(math.Round((r.y+r.h)*float64(size.Y))),
+		)
+	}
+	return group
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+func cropTestInfo(path string, img image.Image) ImageInfo {
+	return ImageInfo{Path: path, Icon: images4.Icon(img), Thumb: newLumaThumb(img)}
+}
+
+// scaleImage resizes img by nearest neighbour.
+func scaleImage(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			out.Set(x, y, img.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+	return out
+}
+
+func TestNewLumaThumbKeepsAspectRatio(t *testing.T) {
+	testCases := []struct {
+		size image.Point
+		want image.Point
+	}{
+		{image.Pt(400, 300), image.Pt(64, 48)},
+		{image.Pt(300, 400), image.Pt(48, 64)},
+		{image.Pt(1000, 10), image.Pt(64, 1)},
+		{image.Pt(5, 5), image.Pt(64, 64)},
+	}
+	for _, tc := range testCases {
+		thumb := newLumaThumb(testPattern(tc.size.X, tc.size.Y))
+		if got := image.Pt(thumb.Width, thumb.Height); got != tc.want || len(thumb.Pix) != got.X*got.Y {
+			t.Errorf("%v: expected a %v thumbnail, got %v with %d pixels", tc.size, tc.want, got, len(thumb.Pix))
+		}
+	}
+	if thumb := newLumaThumb(&image.RGBA{}); thumb.Width != 0 || thumb.Pix != nil {
+		t.Errorf("Expected an empty thumbnail for an empty image, got %+v", thumb)
+	}
+}
+
+func TestFindCropGroups(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	base := randomBlobImage(rng, image.Pt(400, 300))
+	crop := base.SubImage(image.Rect(120, 60, 360, 240))
+
+	padded := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	draw.Draw(padded, image.Rect(0, 50, 400, 350), base, image.Point{}, draw.Src)
+
+	testCases := []struct {
+		name   string
+		infos  []ImageInfo
+		want   []string
+		region image.Rectangle
+	}{
+		{
+			name:   "Crop",
+			infos:  []ImageInfo{cropTestInfo("/crop.jpg", crop), cropTestInfo("/base.jpg", base)},
+			want:   []string{"/base.jpg", "/crop.jpg"},
+			region: image.Rect(120, 60, 360, 240),
+		},
+		{
+			name:   "ScaledCrop",
+			infos:  []ImageInfo{cropTestInfo("/base.jpg", base), cropTestInfo("/small.jpg", scaleImage(crop, 120, 90))},
+			want:   []string{"/base.jpg", "/small.jpg"},
+			region: image.Rect(120, 60, 360, 240),
+		},
+		{
+			name:   "Letterboxed",
+			infos:  []ImageInfo{cropTestInfo("/base.jpg", base), cropTestInfo("/padded.jpg", padded)},
+			want:   []string{"/padded.jpg", "/base.jpg"},
+			region: image.Rect(0, 50, 400, 350),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := findCropGroups(tc.infos, 1)
+			if len(groups) != 1 {
+				t.Fatalf("Expected one group, got %d", len(groups))
+			}
+			group := groups[0]
+			if group.Kind != MatchCrop || fmt.Sprint(group.Paths()) != fmt.Sprint(tc.want) {
+				t.Fatalf("Expected a crop group of %v, got %s group of %v", tc.want, group.Kind, group.Paths())
+			}
+			member := group.Members[1]
+			if member.Score < 0 || member.Score >= 1 {
+				t.Errorf("Expected a score in [0, 1), got %v", member.Score)
+			}
+			// The thumbnails only place the region to within a few percent
+			const slack = 16
+			r := member.Region
+			if abs(r.Min.X-tc.region.Min.X) > slack || abs(r.Min.Y-tc.region.Min.Y) > slack ||
+				abs(r.Max.X-tc.region.Max.X) > slack || abs(r.Max.Y-tc.region.Max.Y) > slack {
+				t.Errorf("Expected region near %v, got %v", tc.region, r)
+			}
+		})
+	}
+}
+
+func TestFindCropGroupsIgnoresUnrelatedImages(t *testing.T) {
+	rng := rand.New(rand.NewSource(11))
+	sizes := []image.Point{{400, 300}, {300, 400}, {320, 320}, {480, 270}}
+	var infos []ImageInfo
+	var first image.Image
+	for i := 0; i < 40; i++ {
+		img := randomBlobImage(rng, sizes[i%len(sizes)])
+		if i == 0 {
+			first = img
+		}
+		infos = append(infos, cropTestInfo(fmt.Sprintf("/%02d.jpg", i), img))
+	}
+	// Near-duplicates are not crops either
+	infos = append(infos, cropTestInfo("/upscaled.jpg", scaleImage(first, 800, 600)))
+
+	if groups := findCropGroups(infos, 1); len(groups) != 0 {
+		for _, group := range groups {
+			t.Errorf("Unexpected crop group %v (scores %v)", group.Paths(), group.Members[1].Score)
+		}
+	}
+}
+
+func TestFindCropGroupsSkipsLargerImages(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	base := randomBlobImage(rng, image.Pt(400, 300))
+	// Upscaled past the size of the image it was cut from
+	crop := scaleImage(base.SubImage(image.Rect(120, 60, 360, 240)), 480, 360)
+
+	if groups := findCropGroups([]ImageInfo{cropTestInfo("/base.jpg", base), cropTestInfo("/big.jpg", crop)}, 1); len(groups) != 0 {
+		t.Errorf("Expected no crop larger than its image, got %v", groups[0].Paths())
+	}
+}
+
+func TestFindSimilarImagesFindCrops(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	base := randomBlobImage(rng, image.Pt(400, 300))
+	infos := []ImageInfo{
+		cropTestInfo("/base.jpg", base),
+		cropTestInfo("/crop.jpg", base.SubImage(image.Rect(40, 40, 280, 220))),
+	}
+	infos[1].FileHash = [16]byte{1}
+
+	if groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive}); len(groups) != 0 {
+		t.Fatalf("Expected no groups without -find-crops, got %v", groups)
+	}
+	groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive, FindCrops: true})
+	if len(groups) != 1 || groups[0].Kind != MatchCrop {
+		t.Fatalf("Expected one crop group, got %v", groups)
+	}
+	if actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q"}); len(actions) != 0 {
+		t.Errorf("Expected crops never to be quarantined, got %v", actions)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
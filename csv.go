@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns lists every column the CSV report can contain, in default order.
+var csvColumns = []string{"group_id", "match_kind", "path", "size", "width", "height", "modified", "md5", "suggested_keep", "transform"}
+
+func parseCSVColumns(s string) ([]string, error) {
+	var columns []string
+	for _, name := range strings.Split(s, ",") {
+		column := strings.ToLower(strings.TrimSpace(name))
+		if !isCSVColumn(column) {
+			return nil, fmt.Errorf("unknown CSV column %q (want %s)", name, strings.Join(csvColumns, ", "))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func isCSVColumn(column string) bool {
+	for _, known := range csvColumns {
+		if column == known {
+			return true
+		}
+	}
+	return false
+}
+
+func csvValue(column string, group DuplicateGroup, member GroupMember, keep bool) string {
+	switch column {
+	case "group_id":
+		return strconv.Itoa(group.ID)
+	case "match_kind":
+		return string(member.Kind)
+	case "path":
+		return member.Path
+	case "size":
+		return strconv.FormatInt(member.Size, 10)
+	case "width":
+		return strconv.Itoa(member.Width)
+	case "height":
+		return strconv.Itoa(member.Height)
+	case "modified":
+		if member.ModTime.IsZero() {
+			return ""
+		}
+		return member.ModTime.UTC().Format(time.RFC3339)
+	case "md5":
+		return hex.EncodeToString(member.FileHash[:])
+	case "suggested_keep":
+		return strconv.FormatBool(keep)
+	case "transform":
+		return string(member.Transform)
+	}
+	return ""
+}
+
+// generateCSVReport writes one row per group member, with a header row.
+func generateCSVReport(groups []DuplicateGroup, outputFile string, columns []string) error {
+	file, err := createOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	row := make([]string, len(columns))
+	for _, group := range groups {
+		keep := group.SuggestedKeep()
+		for i, member := range group.Members {
+			for c, column := range columns {
+				row[c] = csvValue(column, group, member, keep[i])
+			}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCSVColumns(t *testing.T) {
+	columns, err := parseCSVColumns("path, MD5,suggested_keep")
+	if err != nil {
+		t.Fatalf("parseCSVColumns() error = %v", err)
+	}
+	expected := []string{"path", "md5", "suggested_keep"}
+	if !reflect.DeepEqual(columns, expected) {
+		t.Errorf("Expected %v, got %v", expected, columns)
+	}
+
+	if _, err := parseCSVColumns("path,exif"); err == nil {
+		t.Errorf("Expected an error for an unknown column")
+	}
+}
+
+func TestGenerateCSVReport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		columns  []string
+		expected [][]string
+	}{
+		{
+			name:    "AllColumns",
+			columns: csvColumns,
+			expected: [][]string{
+				csvColumns,
+				{"1", "identical", "/photos/a.jpg", "1000", "640", "480", "2024-05-01T12:00:00Z", "abcd0000000000000000000000000000", "true", ""},
+				{"1", "identical", "/photos/copy of a.jpg", "1000", "640", "480", "2024-05-01T12:00:00Z", "abcd0000000000000000000000000000", "false", ""},
+				{"2", "perceptual", "/photos/b.png", "2000", "100", "50", "2024-05-01T12:00:00Z", "00000000000000000000000000000000", "true", ""},
+				{"2", "perceptual", "/photos/b#small.jpg", "300", "50", "25", "2024-05-01T12:00:00Z", "00000000000000000000000000000000", "false", ""},
+			},
+		},
+		{
+			name:    "SelectedColumns",
+			columns: []string{"suggested_keep", "path"},
+			expected: [][]string{
+				{"suggested_keep", "path"},
+				{"true", "/photos/a.jpg"},
+				{"false", "/photos/copy of a.jpg"},
+				{"true", "/photos/b.png"},
+				{"false", "/photos/b#small.jpg"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputFile := filepath.Join(t.TempDir(), "report.csv")
+			if err := generateCSVReport(sampleGroups(), outputFile, tc.columns); err != nil {
+				t.Fatalf("generateCSVReport() error = %v", err)
+			}
+
+			file, err := os.Open(outputFile)
+			if err != nil {
+				t.Fatalf("Failed to open CSV report: %v", err)
+			}
+			defer file.Close()
+
+			records, err := csv.NewReader(file).ReadAll()
+			if err != nil {
+				t.Fatalf("Report is not valid CSV: %v", err)
+			}
+			if !reflect.DeepEqual(records, tc.expected) {
+				t.Errorf("Expected rows %v, got %v", tc.expected, records)
+			}
+		})
+	}
+
+	t.Run("InvalidPath", func(t *testing.T) {
+		if err := generateCSVReport(sampleGroups(), "/invalid/path/report.csv", csvColumns); err == nil {
+			t.Errorf("Expected an error for an invalid output path")
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+)
+
+// AlgoEnsemble names the vote of several algorithms, as selected by
+// -ensemble.
+const AlgoEnsemble HashAlgorithm = "ensemble"
+
+// ensembleHasher lets several algorithms vote: two images are similar when
+// at least quorum of them find the pair within the threshold.
+type ensembleHasher struct {
+	hashers []Hasher
+	quorum  int
+}
+
+func newEnsembleHasher(algorithms []HashAlgorithm, quorum int) ensembleHasher {
+	e := ensembleHasher{quorum: quorum}
+	for _, algorithm := range algorithms {
+		e.hashers = append(e.hashers, hasherFor(algorithm))
+	}
+	if e.quorum <= 0 || e.quorum > len(e.hashers) {
+		e.quorum = len(e.hashers)/2 + 1
+	}
+	return e
+}
+
+func (e ensembleHasher) Algorithm() HashAlgorithm { return AlgoEnsemble }
+
+func (e ensembleHasher) Hash(img image.Image, info *ImageInfo) {
+	for _, h := range e.hashers {
+		h.Hash(img, info)
+	}
+}
+
+// Distance is the quorum-th smallest distance of the algorithms, so a pair
+// is within a threshold exactly when a quorum of them agree it is.
+func (e ensembleHasher) Distance(a, b ImageInfo) float64 {
+	distances := make([]float64, len(e.hashers))
+	for i, h := range e.hashers {
+		distances[i] = h.Distance(a, b)
+	}
+	sort.Float64s(distances)
+	return distances[e.quorum-1]
+}
+
+// distances returns the distance of each algorithm, to show which of them
+// disagreed.
+func (e ensembleHasher) distances(a, b ImageInfo) map[HashAlgorithm]float64 {
+	distances := make(map[HashAlgorithm]float64, len(e.hashers))
+	for _, h := range e.hashers {
+		distances[h.Algorithm()] = h.Distance(a, b)
+	}
+	return distances
+}
+
+// distancesLabel lists the distance of each algorithm, by name.
+func distancesLabel(distances map[HashAlgorithm]float64) string {
+	var parts []string
+	for algorithm, d := range distances {
+		parts = append(parts, fmt.Sprintf("%s %.3f", algorithm, d))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " · ")
+}
+
+// parseEnsemble reads the comma-separated algorithms of -ensemble and
+// checks the quorum against them; a quorum of 0 means a majority.
+func parseEnsemble(s string, quorum int) ([]HashAlgorithm, int, error) {
+	var algorithms []HashAlgorithm
+	seen := make(map[HashAlgorithm]bool)
+	for _, name := range strings.Split(s, ",") {
+		algorithm, err := parseHashAlgorithm(strings.TrimSpace(name))
+		if err != nil {
+			return nil, 0, err
+		}
+		if seen[algorithm] {
+			return nil, 0, fmt.Errorf("%s is listed twice in -ensemble", algorithm)
+		}
+		seen[algorithm] = true
+		algorithms = append(algorithms, algorithm)
+	}
+	if len(algorithms) < 2 {
+		return nil, 0, errors.New("-ensemble needs at least two algorithms")
+	}
+	if quorum == 0 {
+		quorum = len(algorithms)/2 + 1
+	}
+	if quorum < 1 || quorum > len(algorithms) {
+		return nil, 0, fmt.Errorf("invalid quorum %d (want 1 to %d)", quorum, len(algorithms))
+	}
+	return algorithms, quorum, nil
+}
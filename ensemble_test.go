@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/md5"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// hashedInfo gives every image the same icon, so only the hashes differ.
+func hashedInfo(path string, ahash, dhash, phash uint64) ImageInfo {
+	return ImageInfo{
+		Path:     path,
+		FileHash: md5.Sum([]byte(path)),
+		Icon:     images4.Icon(testPattern(64, 48)),
+		Hashes:   map[HashAlgorithm]uint64{AlgoAverage: ahash, AlgoDifference: dhash, AlgoPerception: phash},
+	}
+}
+
+func TestParseEnsemble(t *testing.T) {
+	testCases := []struct {
+		input      string
+		quorum     int
+		want       []HashAlgorithm
+		wantQuorum int
+		wantErr    bool
+	}{
+		{"icon,dhash,phash", 0, []HashAlgorithm{AlgoIcon, AlgoDifference, AlgoPerception}, 2, false},
+		{"icon, dhash", 0, []HashAlgorithm{AlgoIcon, AlgoDifference}, 2, false},
+		{"ahash,dhash,phash,whash", 0, []HashAlgorithm{AlgoAverage, AlgoDifference, AlgoPerception, AlgoWavelet}, 3, false},
+		{"icon,dhash,phash", 1, []HashAlgorithm{AlgoIcon, AlgoDifference, AlgoPerception}, 1, false},
+		{"icon,dhash,phash", 4, nil, 0, true},
+		{"icon,dhash", -1, nil, 0, true},
+		{"phash", 0, nil, 0, true},
+		{"phash,phash", 0, nil, 0, true},
+		{"icon,xhash", 0, nil, 0, true},
+	}
+	for _, tc := range testCases {
+		got, quorum, err := parseEnsemble(tc.input, tc.quorum)
+		if (err != nil) != tc.wantErr || !reflect.DeepEqual(got, tc.want) || quorum != tc.wantQuorum {
+			t.Errorf("parseEnsemble(%q, %d) = %v, %d, %v; expected %v, %d (error %v)",
+				tc.input, tc.quorum, got, quorum, err, tc.want, tc.wantQuorum, tc.wantErr)
+		}
+	}
+}
+
+func TestEnsembleHasherDistance(t *testing.T) {
+	a := hashedInfo("/a.jpg", 0, 0, 0)
+	// ahash agrees exactly, phash is one bit off and dhash twelve
+	b := hashedInfo("/b.jpg", 0, 0xfff, 1)
+	algorithms := []HashAlgorithm{AlgoAverage, AlgoDifference, AlgoPerception}
+
+	testCases := []struct {
+		quorum int
+		want   float64
+	}{
+		{1, 0},
+		{2, 1.0 / 11},
+		{3, 12.0 / 11},
+	}
+	for _, tc := range testCases {
+		if got := newEnsembleHasher(algorithms, tc.quorum).Distance(a, b); got != tc.want {
+			t.Errorf("Quorum %d: expected distance %v, got %v", tc.quorum, tc.want, got)
+		}
+	}
+
+	want := map[HashAlgorithm]float64{AlgoAverage: 0, AlgoDifference: 12.0 / 11, AlgoPerception: 1.0 / 11}
+	if got := newEnsembleHasher(algorithms, 2).distances(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected distances %v, got %v", want, got)
+	}
+}
+
+func TestFindSimilarImagesEnsemble(t *testing.T) {
+	infos := []ImageInfo{
+		hashedInfo("/a.jpg", 0, 0, 0),
+		hashedInfo("/b.jpg", 0, 0xfff, 1),
+		hashedInfo("/c.jpg", 0xffff, 0xffff00, 0xff0000),
+		{Path: "/unhashed.jpg", FileHash: md5.Sum([]byte("/unhashed.jpg")), Icon: images4.Icon(testPattern(64, 48))},
+	}
+	algorithms := []HashAlgorithm{AlgoAverage, AlgoDifference, AlgoPerception}
+
+	groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive, Ensemble: algorithms, Quorum: 2})
+	if len(groups) != 1 || !reflect.DeepEqual(groups[0].Paths(), []string{"/a.jpg", "/b.jpg"}) {
+		t.Fatalf("Expected /a.jpg and /b.jpg grouped, got %v", groups)
+	}
+	member := groups[0].Members[1]
+	if member.Score != 1.0/11 {
+		t.Errorf("Expected the score of the second closest algorithm, got %v", member.Score)
+	}
+	if member.Distances[AlgoDifference] != 12.0/11 {
+		t.Errorf("Expected the dissenting dhash distance to be kept, got %v", member.Distances)
+	}
+
+	if groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive, Ensemble: algorithms, Quorum: 3}); len(groups) != 0 {
+		t.Errorf("Expected no groups when every algorithm must agree, got %v", groups)
+	}
+}
+
+func TestNewJSONGroupSkipsMissingDistances(t *testing.T) {
+	group := DuplicateGroup{ID: 1, Kind: MatchPerceptual, Members: []GroupMember{
+		{ImageInfo: ImageInfo{Path: "/a.jpg"}},
+		{ImageInfo: ImageInfo{Path: "/b.jpg"}, Distances: map[HashAlgorithm]float64{AlgoIcon: 0.5, AlgoPerception: math.Inf(1)}},
+	}}
+	got := newJSONGroup(group)
+	if want := map[HashAlgorithm]float64{AlgoIcon: 0.5}; !reflect.DeepEqual(got.Members[1].Distances, want) {
+		t.Errorf("Expected distances %v, got %v", want, got.Members[1].Distances)
+	}
+	if got.Members[0].Distances != nil {
+		t.Errorf("Expected no distances on the representative, got %v", got.Members[0].Distances)
+	}
+}
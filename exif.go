@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+const tagOrientation = 0x0112
+
+// fileOrientation reads the EXIF Orientation of a JPEG, or of a TIFF-based
+// file such as TIFF or a camera RAW, returning 1 (as stored) when there is
+// none.
+func fileOrientation(r io.ReaderAt) int {
+	head := make([]byte, 4)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return 1
+	}
+	if head[0] == 0xff && head[1] == 0xd8 {
+		return jpegOrientation(r)
+	}
+	return exifOrientation(r)
+}
+
+// jpegOrientation finds the EXIF APP1 segment among the segments before the
+// image data.
+func jpegOrientation(r io.ReaderAt) int {
+	offset := int64(2)
+	header := make([]byte, 4)
+	for {
+		if _, err := r.ReadAt(header, offset); err != nil || header[0] != 0xff {
+			return 1
+		}
+		marker := header[1]
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image; no EXIF
+			return 1
+		}
+		length := int64(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return 1
+		}
+		if marker == 0xe1 {
+			payload := make([]byte, length-2)
+			if _, err := r.ReadAt(payload, offset+4); err != nil {
+				return 1
+			}
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				return exifOrientation(bytes.NewReader(payload[6:]))
+			}
+		}
+		offset += 2 + length
+	}
+}
+
+// exifOrientation reads the Orientation tag from IFD0 of TIFF-structured
+// data, as found in EXIF blocks and TIFF-based files.
+func exifOrientation(r io.ReaderAt) int {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd, _, err := readIFD(r, order, int64(order.Uint32(header[4:])))
+	if err != nil {
+		return 1
+	}
+	if values := ifd[tagOrientation]; len(values) == 1 && values[0] >= 1 && values[0] <= 8 {
+		return int(values[0])
+	}
+	return 1
+}
+
+// orientImage returns img as it should be displayed under the given EXIF
+// orientation. The transform is applied lazily, pixel by pixel, so no copy
+// of the image is made.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	return orientedImage{src: img, orientation: orientation}
+}
+
+type orientedImage struct {
+	src         image.Image
+	orientation int
+}
+
+// swapsAxes reports whether the orientation turns the image by 90°.
+func (o orientedImage) swapsAxes() bool {
+	return o.orientation >= 5
+}
+
+func (o orientedImage) ColorModel() color.Model {
+	return o.src.ColorModel()
+}
+
+func (o orientedImage) Bounds() image.Rectangle {
+	size := o.src.Bounds().Size()
+	if o.swapsAxes() {
+		return image.Rect(0, 0, size.Y, size.X)
+	}
+	return image.Rect(0, 0, size.X, size.Y)
+}
+
+func (o orientedImage) At(x, y int) color.Color {
+	b := o.src.Bounds()
+	sx, sy := orientSource(o.orientation, x, y, b.Dx(), b.Dy())
+	return o.src.At(b.Min.X+sx, b.Min.Y+sy)
+}
+
+// orientSource maps (x, y) in the displayed image to the stored pixel it
+// comes from, for a stored image of w×h pixels.
+func orientSource(orientation, x, y, w, h int) (sx, sy int) {
+	switch orientation {
+	case 2: // mirrored horizontally
+		return w - 1 - x, y
+	case 3: // rotated 180°
+		return w - 1 - x, h - 1 - y
+	case 4: // mirrored vertically
+		return x, h - 1 - y
+	case 5: // transposed
+		return y, x
+	case 6: // stored rotated 90° counter-clockwise
+		return y, h - 1 - x
+	case 7: // transversed
+		return w - 1 - y, h - 1 - x
+	case 8: // stored rotated 90° clockwise
+		return w - 1 - y, x
+	}
+	return x, y
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// exifSegment builds a JPEG APP1 segment holding only an Orientation tag.
+func exifSegment(orientation uint16, order binary.ByteOrder) []byte {
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II*\x00")
+	} else {
+		tiff.WriteString("MM\x00*")
+	}
+	binary.Write(&tiff, order, uint32(8))
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, []uint16{tagOrientation, 3})
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, []uint16{orientation, 0})
+	binary.Write(&tiff, order, uint32(0))
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// writeOrientedJPEG writes img as a JPEG, with an EXIF Orientation tag
+// unless orientation is 0.
+func writeOrientedJPEG(t *testing.T, path string, img image.Image, orientation uint16, order binary.ByteOrder) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if orientation != 0 {
+		// The segment goes right after the SOI marker
+		data = append(append(append([]byte{}, data[:2]...), exifSegment(orientation, order)...), data[2:]...)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPattern(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x * y) % 256), 255})
+		}
+	}
+	return img
+}
+
+// storeAs returns the pixels a camera would store for an image displayed as
+// img under the given orientation, by applying the inverse transform.
+func storeAs(img image.Image, orientation int) image.Image {
+	inverse := map[int]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 8, 7: 7, 8: 6}
+	return orientImage(img, inverse[orientation])
+}
+
+func TestOrientImage(t *testing.T) {
+	src := testPattern(3, 2)
+	for orientation := 1; orientation <= 8; orientation++ {
+		round := orientImage(storeAs(src, orientation), orientation)
+		if round.Bounds() != src.Bounds() {
+			t.Errorf("Orientation %d: bounds %v, want %v", orientation, round.Bounds(), src.Bounds())
+			continue
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				if round.At(x, y) != src.At(x, y) {
+					t.Errorf("Orientation %d: pixel (%d, %d) differs", orientation, x, y)
+				}
+			}
+		}
+	}
+
+	// Orientation 6 means the stored image must be turned clockwise
+	rotated := orientImage(src, 6)
+	if rotated.Bounds().Size() != (image.Point{2, 3}) || rotated.At(0, 0) != src.At(0, 1) {
+		t.Errorf("Orientation 6 does not rotate clockwise")
+	}
+}
+
+func TestOpenAppliesEXIFOrientation(t *testing.T) {
+	dir := t.TempDir()
+	upright := testPattern(64, 48)
+	writeOrientedJPEG(t, filepath.Join(dir, "upright.jpg"), upright, 0, nil)
+
+	opener := DefaultImageOpener{}
+	want, err := opener.Open(filepath.Join(dir, "upright.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIcon := images4.Icon(want)
+
+	for orientation := 2; orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			path := filepath.Join(dir, "rotated.jpg")
+			writeOrientedJPEG(t, path, storeAs(upright, orientation), uint16(orientation), order)
+			img, err := opener.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Size() != upright.Bounds().Size() {
+				t.Errorf("Orientation %d (%v): size %v", orientation, order, img.Bounds().Size())
+				continue
+			}
+			if !images4.Similar(wantIcon, images4.Icon(img)) {
+				t.Errorf("Orientation %d (%v): not similar to the upright image", orientation, order)
+			}
+		}
+	}
+}
+
+func TestFileOrientationDefaults(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":          nil,
+		"png":            []byte("\x89PNG\r\n\x1a\n"),
+		"jpeg, no exif":  {0xff, 0xd8, 0xff, 0xda, 0, 2},
+		"truncated exif": {0xff, 0xd8, 0xff, 0xe1, 0x10, 0},
+	}
+	for name, data := range tests {
+		if got := fileOrientation(bytes.NewReader(data)); got != 1 {
+			t.Errorf("%s: orientation %d, want 1", name, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	// Decoders for the formats beyond JPEG and PNG, registered with
+	// image.Decode
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// imageFormats lists every format that can be scanned, in -types order.
+var imageFormats = []string{"jpeg", "png", "gif", "bmp", "tiff", "webp", rawFormat}
+
+// imageExtensions maps the extensions scanned by default to the format
+// their content should have.
+var imageExtensions = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".jfif": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".bmp":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".webp": "webp",
+	".cr2":  rawFormat,
+	".nef":  rawFormat,
+	".arw":  rawFormat,
+	".dng":  rawFormat,
+}
+
+// contentFormats maps the MIME types reported by http.DetectContentType to
+// the formats that can be decoded. TIFF is not detected by it and is
+// checked separately.
+var contentFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/bmp":  "bmp",
+	"image/webp": "webp",
+}
+
+var formatAliases = map[string]string{
+	"jpg": "jpeg",
+	"tif": "tiff",
+}
+
+// parseImageTypes reads a comma-separated list of formats for -types.
+func parseImageTypes(s string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		format := strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := formatAliases[format]; ok {
+			format = alias
+		}
+		if !isImageFormat(format) {
+			return nil, fmt.Errorf("unknown image type %q (want %s)", name, strings.Join(imageFormats, ", "))
+		}
+		types[format] = true
+	}
+	return types, nil
+}
+
+func isImageFormat(format string) bool {
+	for _, known := range imageFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionFormat returns the format a file's extension claims, or "".
+func extensionFormat(path string) string {
+	return imageExtensions[strings.ToLower(filepath.Ext(path))]
+}
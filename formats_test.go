@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImageFormatFixtures(t *testing.T) {
+	images, err := scanDirectoryRecursive(filepath.Join("testdata", "formats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != len(imageFormats) {
+		t.Fatalf("Expected one fixture per format, found %v", images)
+	}
+
+	for _, path := range images {
+		detected, err := sniffFormat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := extensionFormat(path)
+		if want == rawFormat {
+			want = "tiff"
+		}
+		if detected != want {
+			t.Errorf("%s: sniffed %q, want %q", path, detected, want)
+		}
+		img, err := RawImageOpener{Next: DefaultImageOpener{}}.Open(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if size := img.Bounds().Size(); size.X != 150 || size.Y != 103 {
+			t.Errorf("%s: decoded as %v", path, size)
+		}
+	}
+
+	infos, err := computeHashes(images, make(chan string, len(images)), RawImageOpener{Next: DefaultImageOpener{}}, DefaultIconCreator{}, DefaultFileHasher{}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lossless formats decode to the same pixels; the lossy ones and
+	// the DNG's preview only look alike, and the DNG is paired with them
+	// rather than a duplicate
+	groups := findSimilarImages(infos, SimilarityOptions{})
+	if len(groups) != 1 || groups[0].Kind != MatchPerceptual {
+		t.Fatalf("Expected one perceptual group, got %+v", groups)
+	}
+	want := map[string]MatchKind{
+		"sample.bmp":  MatchPerceptual,
+		"sample.png":  MatchPixelIdentical,
+		"sample.tiff": MatchPixelIdentical,
+		"sample.webp": MatchPixelIdentical,
+		"sample.dng":  MatchRawPair,
+		"sample.gif":  MatchPerceptual,
+		"sample.jpg":  MatchPerceptual,
+	}
+	got := make(map[string]MatchKind)
+	for _, member := range groups[0].Members {
+		got[filepath.Base(member.Path)] = member.Kind
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected members %v, got %v", want, got)
+	}
+
+	// Every copy but the DNG can go, or only the lossless ones when
+	// similar images are kept
+	actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q"})
+	if len(actions) != len(want)-2 {
+		t.Errorf("Expected %d images moved, got %+v", len(want)-2, actions)
+	}
+	for _, action := range actions {
+		if isRawFile(action.Source) || isRawFile(action.Keep) {
+			t.Errorf("Expected the DNG to be left alone, got %+v", action)
+		}
+	}
+	kinds := map[MatchKind]bool{MatchIdentical: true, MatchPixelIdentical: true}
+	if actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q", Kinds: kinds}); len(actions) != 3 {
+		t.Errorf("Expected the three lossless copies moved, got %+v", actions)
+	}
+}
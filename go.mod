@@ -5,14 +5,15 @@ go 1.22.2
 require (
 	github.com/briandowns/spinner v1.23.1
 	github.com/corona10/goimagehash v1.1.0
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/vitali-fedulov/images4 v1.3.1
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
 )
 
 require (
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/mattn/go-colorable v0.1.2 // indirect
 	github.com/mattn/go-isatty v0.0.8 // indirect
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/vitali-fedulov/images4 v1.3.1 // indirect
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 	golang.org/x/term v0.1.0 // indirect
 )
@@ -0,0 +1,186 @@
+package main
+
+import "image"
+
+// MatchKind records why an image was put in a group.
+type MatchKind string
+
+const (
+	// MatchIdentical means the file bytes are identical (same MD5).
+	MatchIdentical MatchKind = "identical"
+	// MatchPixelIdentical means the files differ, in metadata or encoding,
+	// but decode to exactly the same pixels.
+	MatchPixelIdentical MatchKind = "pixel-identical"
+	// MatchPerceptual means the images look alike but the files differ.
+	MatchPerceptual MatchKind = "perceptual"
+	// MatchRawPair means a camera RAW file and another format look alike,
+	// usually the RAW and JPEG a camera saved of the same shot. Both are
+	// worth keeping, so these groups are never acted on.
+	MatchRawPair MatchKind = "raw-pair"
+	// MatchCrop means an image is a crop of the representative, or the
+	// representative is a letterboxed or padded copy of it. They are
+	// different pictures, so these groups are never acted on either.
+	MatchCrop MatchKind = "crop"
+)
+
+// DuplicateGroup is a set of images found to be duplicates of each other.
+// The first member is the representative every other member is scored
+// against.
+type DuplicateGroup struct {
+	ID      int
+	Kind    MatchKind
+	Members []GroupMember
+}
+
+// GroupMember is one image in a DuplicateGroup. Kind describes how it
+// relates to the representative, and Score is its distance to it: 0 for an
+// identical image, growing towards the threshold for weaker matches.
+// Transform is set when the member matched a rotated or mirrored copy of
+// the representative, and Region, for a crop, is where in the
+// representative it was cut from. With -ensemble, Distances holds the
+// distance measured by each algorithm that voted.
+type GroupMember struct {
+	ImageInfo
+	Width     int
+	Height    int
+	Kind      MatchKind
+	Score     float64
+	Transform Transform
+	Region    image.Rectangle
+	Distances map[HashAlgorithm]float64
+}
+
+func (g DuplicateGroup) Representative() GroupMember {
+	return g.Members[0]
+}
+
+// removable reports whether member i may be removed in favour of another
+// member. RAW/JPEG pairs and crops never are, nor the RAW files of a group
+// of duplicates in other formats, other than byte-identical copies of one
+// of them.
+func (g DuplicateGroup) removable(i int) bool {
+	if g.Kind == MatchRawPair || g.Kind == MatchCrop {
+		return false
+	}
+	return g.Members[i].Kind != MatchRawPair || g.rawOriginal(i) >= 0
+}
+
+// rawOriginal returns the earlier RAW file of a RAW/JPEG pair that member i
+// is a byte-identical copy of, or -1.
+func (g DuplicateGroup) rawOriginal(i int) int {
+	if g.Members[i].Kind != MatchRawPair {
+		return -1
+	}
+	for j := 0; j < i; j++ {
+		if kind, ok := exactMatch(g.Members[j].ImageInfo, g.Members[i].ImageInfo); ok && kind == MatchIdentical && g.Members[j].Kind == MatchRawPair {
+			return j
+		}
+	}
+	return -1
+}
+
+// matchBetween returns how members a and b match. Each member's Kind
+// relates it to the representative, so other pairs are compared by their
+// hashes, and are otherwise only visually similar.
+func (g DuplicateGroup) matchBetween(a, b int) MatchKind {
+	if kind, ok := exactMatch(g.Members[a].ImageInfo, g.Members[b].ImageInfo); ok {
+		return kind
+	}
+	switch {
+	case a == 0:
+		return g.memberKind(b)
+	case b == 0:
+		return g.memberKind(a)
+	}
+	if ka, kb := g.memberKind(a), g.memberKind(b); isExactKind(ka) && isExactKind(kb) {
+		if ka == MatchIdentical && kb == MatchIdentical {
+			return MatchIdentical
+		}
+		return MatchPixelIdentical
+	}
+	return MatchPerceptual
+}
+
+// parts splits the group into the sets of members that apply may act on
+// under kinds, as member indices: the whole group when visually similar
+// images may be removed, and otherwise the sets of exact copies of each
+// other.
+func (g DuplicateGroup) parts(kinds map[MatchKind]bool) [][]int {
+	if kinds == nil || kinds[MatchPerceptual] {
+		return [][]int{g.indices()}
+	}
+	var parts [][]int
+next:
+	for i := range g.Members {
+		for p, part := range parts {
+			if kinds[g.matchBetween(part[0], i)] {
+				parts[p] = append(part, i)
+				continue next
+			}
+		}
+		parts = append(parts, []int{i})
+	}
+	return parts
+}
+
+// memberKind is the Kind of member i, which defaults to the group's.
+func (g DuplicateGroup) memberKind(i int) MatchKind {
+	if g.Members[i].Kind == "" {
+		return g.Kind
+	}
+	return g.Members[i].Kind
+}
+
+// indices returns the index of every member.
+func (g DuplicateGroup) indices() []int {
+	indices := make([]int, len(g.Members))
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+func isExactKind(kind MatchKind) bool {
+	return kind == MatchIdentical || kind == MatchPixelIdentical
+}
+
+func (g DuplicateGroup) Paths() []string {
+	paths := make([]string, len(g.Members))
+	for i, member := range g.Members {
+		paths[i] = member.Path
+	}
+	return paths
+}
+
+// SuggestedKeep reports which members are worth keeping under the default
+// policy: the one with the most pixels, then the largest file, then the
+// oldest, then the first listed, and every member that is never removed,
+// such as both sides of a RAW/JPEG pair and every image of a crop group.
+func (g DuplicateGroup) SuggestedKeep() []bool {
+	keep := make([]bool, len(g.Members))
+	keeper := defaultKeepPolicy.Keeper(g)
+	for i := range g.Members {
+		keep[i] = i == keeper || !g.removable(i)
+	}
+	return keep
+}
+
+// newDuplicateGroup builds a group from its images, representative first.
+// Byte- and pixel-identical groups are known to be exact and skip the
+// comparison.
+func newDuplicateGroup(kind MatchKind, images []ImageInfo) DuplicateGroup {
+	group := DuplicateGroup{Kind: kind, Members: make([]GroupMember, len(images))}
+	for i, img := range images {
+		member := GroupMember{
+			ImageInfo: img,
+			Width:     img.Icon.ImgSize.X,
+			Height:    img.Icon.ImgSize.Y,
+			Kind:      kind,
+		}
+		if i > 0 && kind != MatchIdentical && kind != MatchPixelIdentical {
+			member.Score = iconDistance(images[0].Icon, img.Icon)
+		}
+		group.Members[i] = member
+	}
+	return group
+}
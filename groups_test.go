@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSuggestedKeep(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	testCases := []struct {
+		name     string
+		members  []GroupMember
+		expected int
+	}{
+		{
+			name: "MostPixels",
+			members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/small.jpg", Size: 9000}, Width: 100, Height: 100},
+				{ImageInfo: ImageInfo{Path: "/large.jpg", Size: 10}, Width: 200, Height: 200},
+			},
+			expected: 1,
+		},
+		{
+			name: "LargestFileOnEqualPixels",
+			members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/a.jpg", Size: 10}, Width: 100, Height: 100},
+				{ImageInfo: ImageInfo{Path: "/b.jpg", Size: 20}, Width: 100, Height: 100},
+			},
+			expected: 1,
+		},
+		{
+			name: "OldestOnEqualSize",
+			members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/new.jpg", Size: 10, ModTime: newer}},
+				{ImageInfo: ImageInfo{Path: "/old.jpg", Size: 10, ModTime: older}},
+			},
+			expected: 1,
+		},
+		{
+			name: "FirstOnTie",
+			members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/a.jpg", Size: 10, ModTime: older}},
+				{ImageInfo: ImageInfo{Path: "/b.jpg", Size: 10, ModTime: older}},
+			},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			group := DuplicateGroup{Members: tc.members}
+			want := make([]bool, len(tc.members))
+			want[tc.expected] = true
+			if got := group.SuggestedKeep(); !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected keep %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestSuggestedKeepNeverRemovable(t *testing.T) {
+	testCases := []struct {
+		name  string
+		group DuplicateGroup
+		want  []bool
+	}{
+		{
+			name: "RawPair",
+			group: DuplicateGroup{Kind: MatchRawPair, Members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/a.dng", Size: 10}, Kind: MatchRawPair},
+				{ImageInfo: ImageInfo{Path: "/a.jpg", Size: 20}, Width: 100, Height: 100, Kind: MatchRawPair},
+			}},
+			want: []bool{true, true},
+		},
+		{
+			name: "Letterbox",
+			group: DuplicateGroup{Kind: MatchCrop, Members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/padded.jpg", Size: 20}, Width: 400, Height: 400, Kind: MatchCrop},
+				{ImageInfo: ImageInfo{Path: "/original.jpg", Size: 10}, Width: 400, Height: 300, Kind: MatchCrop},
+			}},
+			want: []bool{true, true},
+		},
+		{
+			name: "RawAmongDuplicates",
+			group: DuplicateGroup{Kind: MatchPerceptual, Members: []GroupMember{
+				{ImageInfo: ImageInfo{Path: "/a.dng"}, Kind: MatchRawPair},
+				{ImageInfo: ImageInfo{Path: "/a.jpg", Size: 20}, Kind: MatchPerceptual},
+				{ImageInfo: ImageInfo{Path: "/a.gif", Size: 10}, Kind: MatchPerceptual},
+			}},
+			want: []bool{true, true, false},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.group.SuggestedKeep(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Expected keep %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// hammingIndex is a BK-tree over one bit hash, so an image's neighbours
+// within a Hamming radius are found without comparing it to every other
+// image. Every child hangs off its parent by their distance, and by the
+// triangle inequality a query only needs the children whose distance is
+// within the radius of its own distance to the parent. Images without the
+// hash are left out, as they cannot match by it.
+type hammingIndex struct {
+	radius int
+	hashes []uint64
+	hashed []bool
+	nodes  []hammingNode
+}
+
+type hammingNode struct {
+	hash     uint64
+	images   []int // every image with exactly this hash
+	children []hammingEdge
+}
+
+type hammingEdge struct {
+	distance uint8
+	node     int32
+}
+
+func newHammingIndex(images []ImageInfo, algorithm HashAlgorithm, radius int) *hammingIndex {
+	idx := &hammingIndex{
+		radius: radius,
+		hashes: make([]uint64, len(images)),
+		hashed: make([]bool, len(images)),
+	}
+	for i, img := range images {
+		if hash, ok := img.Hashes[algorithm]; ok {
+			idx.hashes[i], idx.hashed[i] = hash, true
+			idx.insert(i, hash)
+		}
+	}
+	return idx
+}
+
+func (idx *hammingIndex) insert(i int, hash uint64) {
+	if len(idx.nodes) == 0 {
+		idx.nodes = append(idx.nodes, hammingNode{hash: hash, images: []int{i}})
+		return
+	}
+	n := 0
+	for {
+		d := uint8(bits.OnesCount64(idx.nodes[n].hash ^ hash))
+		if d == 0 {
+			idx.nodes[n].images = append(idx.nodes[n].images, i)
+			return
+		}
+		next := -1
+		for _, edge := range idx.nodes[n].children {
+			if edge.distance == d {
+				next = int(edge.node)
+				break
+			}
+		}
+		if next < 0 {
+			idx.nodes = append(idx.nodes, hammingNode{hash: hash, images: []int{i}})
+			idx.nodes[n].children = append(idx.nodes[n].children, hammingEdge{d, int32(len(idx.nodes) - 1)})
+			return
+		}
+		n = next
+	}
+}
+
+// Candidates returns, in ascending order, the indices of the images whose
+// hash is within the radius of image i's. Image i itself is not included.
+func (idx *hammingIndex) Candidates(i int) []int {
+	if !idx.hashed[i] || len(idx.nodes) == 0 {
+		return nil
+	}
+	hash := idx.hashes[i]
+	var candidates []int
+	stack := []int{0}
+	for len(stack) > 0 {
+		node := &idx.nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		d := bits.OnesCount64(node.hash ^ hash)
+		if d <= idx.radius {
+			for _, j := range node.images {
+				if j != i {
+					candidates = append(candidates, j)
+				}
+			}
+		}
+		for _, edge := range node.children {
+			if e := int(edge.distance); e >= d-idx.radius && e <= d+idx.radius {
+				stack = append(stack, int(edge.node))
+			}
+		}
+	}
+	sort.Ints(candidates)
+	return candidates
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHammingIndexCandidatesAreComplete(t *testing.T) {
+	rng := rand.New(rand.NewSource(17))
+	// Clusters of nearby hashes, as copies of a picture give, and a few
+	// images without a hash
+	var infos []ImageInfo
+	for len(infos) < 400 {
+		center := rng.Uint64()
+		for v := rng.Intn(5); v >= 0; v-- {
+			hash := center
+			for flips := rng.Intn(14); flips > 0; flips-- {
+				hash ^= 1 << rng.Intn(64)
+			}
+			info := ImageInfo{Path: fmt.Sprintf("/%03d.jpg", len(infos))}
+			if rng.Intn(20) > 0 {
+				info.Hashes = map[HashAlgorithm]uint64{AlgoDifference: hash}
+			}
+			infos = append(infos, info)
+		}
+	}
+
+	for _, radius := range []int{0, 5, 10, 21} {
+		index := newHammingIndex(infos, AlgoDifference, radius)
+		for i := range infos {
+			var want []int
+			a, ok := infos[i].Hashes[AlgoDifference]
+			for j := range infos {
+				b, hashed := infos[j].Hashes[AlgoDifference]
+				if ok && hashed && j != i && bits.OnesCount64(a^b) <= radius {
+					want = append(want, j)
+				}
+			}
+			if got := index.Candidates(i); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Radius %d, image %d: expected candidates %v, got %v", radius, i, want, got)
+			}
+		}
+	}
+}
+
+func TestGroupByImageSimilarityMatchesBruteForceForHashes(t *testing.T) {
+	infos := syntheticImageInfos(250, 4)
+	testCases := []struct {
+		name string
+		opts SimilarityOptions
+	}{
+		{"ahash", SimilarityOptions{Algorithm: AlgoAverage}},
+		{"dhash", SimilarityOptions{Algorithm: AlgoDifference}},
+		{"phash", SimilarityOptions{Algorithm: AlgoPerception, Threshold: 2}},
+		{"whash", SimilarityOptions{Algorithm: AlgoWavelet, Threshold: 0.5}},
+		{"Ensemble", SimilarityOptions{Ensemble: []HashAlgorithm{AlgoIcon, AlgoDifference, AlgoPerception}}},
+		{"EnsembleAll", SimilarityOptions{Ensemble: []HashAlgorithm{AlgoIcon, AlgoAverage, AlgoDifference}, Quorum: 3}},
+		{"EnsembleAny", SimilarityOptions{Ensemble: []HashAlgorithm{AlgoIcon, AlgoWavelet}, Quorum: 1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Grouping = GroupingAnchor
+			hasher, threshold := tc.opts.hasher(), tc.opts.threshold()
+			want := bruteForceGroups(infos, func(a, b ImageInfo) bool { return hasher.Distance(a, b) < threshold })
+			got := groupByImageSimilarity(infos, tc.opts)
+			if len(want) == 0 {
+				t.Fatalf("Corpus produced no similar groups; the test would prove nothing")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Indexed grouping differs from brute force:\nwant %v\ngot  %v", want, got)
+			}
+		})
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"crypto/md5"
 	"errors"
+	"fmt"
 	"image"
-
+	"image/draw"
+	"math"
+	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -88,7 +92,7 @@ func TestComputeHashes(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			progress := make(chan string, len(tc.imagePaths))
 
-			imageInfos, err := computeHashes(tc.imagePaths, progress, MockImageOpener{}, MockIconCreator{}, MockFileHasher{})
+			imageInfos, err := computeHashes(tc.imagePaths, progress, MockImageOpener{}, MockIconCreator{}, MockFileHasher{}, 2, nil)
 
 			if err != nil {
 				t.Errorf("computeHashes returned an error: %v", err)
@@ -149,6 +153,32 @@ func TestComputeHashes(t *testing.T) {
 	}
 }
 
+func TestComputeHashesRecordsFileStats(t *testing.T) {
+	content := []byte("twelve bytes")
+	file := createTempFile(t, content)
+	defer removeTempFiles(t, []string{file})
+
+	progress := make(chan string, 1)
+	imageInfos, err := computeHashes([]string{file}, progress, MockImageOpener{}, MockIconCreator{}, MockFileHasher{}, 1, nil)
+	if err != nil {
+		t.Fatalf("computeHashes returned an error: %v", err)
+	}
+	if len(imageInfos) != 1 {
+		t.Fatalf("Expected 1 ImageInfo, got %d", len(imageInfos))
+	}
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if imageInfos[0].Size != int64(len(content)) {
+		t.Errorf("Expected size %d, got %d", len(content), imageInfos[0].Size)
+	}
+	if !imageInfos[0].ModTime.Equal(stat.ModTime()) {
+		t.Errorf("Expected mod time %v, got %v", stat.ModTime(), imageInfos[0].ModTime)
+	}
+}
+
 func TestDefaultFileHasher(t *testing.T) {
 	hasher := DefaultFileHasher{}
 
@@ -209,3 +239,216 @@ func TestDefaultFileHasher(t *testing.T) {
 		}
 	})
 }
+
+func TestComputeHashesPreservesOrder(t *testing.T) {
+	var paths []string
+	for i := 0; i < 50; i++ {
+		paths = append(paths, fmt.Sprintf("image%02d.jpg", i))
+	}
+	paths = append(paths[:10], append([]string{"nonexistent.jpg"}, paths[10:]...)...)
+
+	for _, workers := range []int{0, 1, 4, 16} {
+		t.Run(fmt.Sprintf("Workers%d", workers), func(t *testing.T) {
+			progress := make(chan string, len(paths))
+			imageInfos, err := computeHashes(paths, progress, MockImageOpener{}, MockIconCreator{}, MockFileHasher{}, workers, nil)
+			if err != nil {
+				t.Fatalf("computeHashes returned an error: %v", err)
+			}
+			close(progress)
+
+			var got []string
+			for _, info := range imageInfos {
+				got = append(got, info.Path)
+			}
+			var want []string
+			for _, p := range paths {
+				if p != "nonexistent.jpg" {
+					want = append(want, p)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected paths in input order %v, got %v", want, got)
+			}
+
+			updates := 0
+			for range progress {
+				updates++
+			}
+			if updates != len(paths) {
+				t.Errorf("Expected %d progress updates, got %d", len(paths), updates)
+			}
+		})
+	}
+}
+
+func bitHashTestInfo(path string, img image.Image) ImageInfo {
+	info := cropTestInfo(path, img)
+	info.FileHash = md5.Sum([]byte(path))
+	for _, h := range bitHashers {
+		h.Hash(info.Thumb.image(), &info)
+	}
+	return info
+}
+
+func TestParseHashAlgorithm(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    HashAlgorithm
+		wantErr bool
+	}{
+		{"icon", AlgoIcon, false},
+		{"ahash", AlgoAverage, false},
+		{"DHash", AlgoDifference, false},
+		{"phash", AlgoPerception, false},
+		{"whash", AlgoWavelet, false},
+		{"md5", "", true},
+		{"", "", true},
+	}
+	for _, tc := range testCases {
+		got, err := parseHashAlgorithm(tc.input)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseHashAlgorithm(%q) = %q, %v; expected %q (error %v)", tc.input, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestBitHashersDistance(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	var bases []*image.RGBA
+	var infos, variants []ImageInfo
+	for i := 0; i < 20; i++ {
+		base := randomBlobImage(rng, image.Pt(160, 120))
+		bases = append(bases, base)
+		infos = append(infos, bitHashTestInfo(fmt.Sprintf("/%02d.jpg", i), base))
+		variants = append(variants, bitHashTestInfo(fmt.Sprintf("/%02d-copy.jpg", i), varyImage(rng, base)))
+	}
+
+	for _, h := range bitHashers {
+		t.Run(string(h.Algorithm()), func(t *testing.T) {
+			for i := range infos {
+				if d := h.Distance(infos[i], variants[i]); d >= 1 {
+					t.Errorf("%s: expected its variant within the threshold, got distance %v", infos[i].Path, d)
+				}
+			}
+			unrelated := 0
+			for i := 1; i < len(infos); i++ {
+				if h.Distance(infos[0], infos[i]) >= 1 {
+					unrelated++
+				}
+			}
+			if unrelated < len(infos)-2 {
+				t.Errorf("Expected unrelated images beyond the threshold, only %d of %d were", unrelated, len(infos)-1)
+			}
+			if d := h.Distance(infos[0], ImageInfo{}); !math.IsInf(d, 1) {
+				t.Errorf("Expected an infinite distance to an image without hashes, got %v", d)
+			}
+		})
+	}
+}
+
+func TestFindSimilarImagesWithAlgorithm(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	var infos []ImageInfo
+	for i := 0; i < 10; i++ {
+		base := randomBlobImage(rng, image.Pt(160, 120))
+		infos = append(infos, bitHashTestInfo(fmt.Sprintf("/%02d.jpg", i), base))
+		if i < 3 {
+			infos = append(infos, bitHashTestInfo(fmt.Sprintf("/%02d-copy.jpg", i), varyImage(rng, base)))
+		}
+	}
+
+	for _, algorithm := range []HashAlgorithm{AlgoAverage, AlgoDifference, AlgoPerception, AlgoWavelet} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive, Algorithm: algorithm})
+			var got []string
+			for _, group := range groups {
+				paths := group.Paths()
+				sort.Strings(paths)
+				got = append(got, fmt.Sprint(paths))
+				if score := group.Members[1].Score; score >= 1 {
+					t.Errorf("Expected member scores below 1, got %v", score)
+				}
+			}
+			want := []string{"[/00-copy.jpg /00.jpg]", "[/01-copy.jpg /01.jpg]", "[/02-copy.jpg /02.jpg]"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected groups %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestPixelHash(t *testing.T) {
+	src := testPattern(30, 20)
+	nrgba := image.NewNRGBA(src.Bounds())
+	draw.Draw(nrgba, nrgba.Rect, src, image.Point{}, draw.Src)
+	offset := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	draw.Draw(offset, image.Rect(10, 10, 40, 30), src, image.Point{}, draw.Src)
+	changed := image.NewRGBA(src.Bounds())
+	draw.Draw(changed, changed.Rect, src, image.Point{}, draw.Src)
+	changed.Pix[0]++
+
+	want := pixelHash(src)
+	if want == ([16]byte{}) {
+		t.Fatal("Expected a non-zero pixel hash")
+	}
+	testCases := []struct {
+		name string
+		img  image.Image
+		same bool
+	}{
+		{"NRGBA", nrgba, true},
+		{"Offset", offset.SubImage(image.Rect(10, 10, 40, 30)), true},
+		{"OnePixelChanged", changed, false},
+		{"Transposed", orientImage(src, 5), false},
+	}
+	for _, tc := range testCases {
+		if got := pixelHash(tc.img); (got == want) != tc.same {
+			t.Errorf("%s: expected same hash %v, got %x and %x", tc.name, tc.same, got, want)
+		}
+	}
+	if got := pixelHash(&image.RGBA{}); got != ([16]byte{}) {
+		t.Errorf("Expected a zero hash for an empty image, got %x", got)
+	}
+}
+
+func TestPixelHashOrientedBands(t *testing.T) {
+	// Large enough to be hashed in more than one band
+	src := testPattern(700, 500)
+	want := pixelHash(src)
+	for orientation := 1; orientation <= 8; orientation++ {
+		// Stored the way a decoder returns it, away from the origin
+		stored := storeAs(src, orientation)
+		rect := stored.Bounds().Add(image.Pt(5, 7))
+		decoded := image.NewRGBA(rect)
+		draw.Draw(decoded, rect, stored, image.Point{}, draw.Src)
+		if got := pixelHash(orientImage(decoded, orientation)); got != want {
+			t.Errorf("Orientation %d: expected hash %x, got %x", orientation, want, got)
+		}
+	}
+
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 640, 480), image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = uint8(i * 7)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i), uint8(i*3)
+	}
+	rotated := orientImage(ycbcr, 6)
+	rgba := image.NewRGBA(rotated.Bounds())
+	draw.Draw(rgba, rgba.Rect, rotated, image.Point{}, draw.Src)
+	if pixelHash(rotated) != pixelHash(rgba) {
+		t.Errorf("Expected a rotated YCbCr image to hash like its RGBA pixels")
+	}
+}
+
+func BenchmarkPixelHash(b *testing.B) {
+	img := image.NewYCbCr(image.Rect(0, 0, 4000, 3000), image.YCbCrSubsampleRatio420)
+	for _, orientation := range []int{1, 6} {
+		b.Run(fmt.Sprintf("Orientation%d", orientation), func(b *testing.B) {
+			oriented := orientImage(img, orientation)
+			for i := 0; i < b.N; i++ {
+				pixelHash(oriented)
+			}
+		})
+	}
+}
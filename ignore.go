@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dupeignoreName is the per-directory ignore file honoured while scanning.
+const dupeignoreName = ".dupeignore"
+
+// ScanFilter narrows down a directory walk. Patterns use the .dupeignore
+// syntax and are matched relative to the scanned root. Excluded directories
+// are not descended into; when Include is set, only files matching one of
+// its patterns, or inside a matching directory, are kept.
+type ScanFilter struct {
+	Include []string
+	Exclude []string
+	// Types limits the walk to the extensions of these formats; nil means
+	// every supported format.
+	Types map[string]bool
+	// AnyExtension keeps files regardless of their extension, for callers
+	// that sniff their content.
+	AnyExtension bool
+}
+
+// ignoreRule is one gitignore-style pattern. base is the slash-separated
+// directory, relative to the scanned root, whose .dupeignore defined it.
+type ignoreRule struct {
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns match the whole path below base; others match the
+	// name of a file or directory at any depth.
+	anchored bool
+}
+
+// parseIgnorePattern parses one line of a .dupeignore file. Blank lines and
+// comments return ok == false.
+func parseIgnorePattern(line, base string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	rule.base = base
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return rule, false, nil
+	}
+
+	rule.segments = strings.Split(line, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return rule, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	return rule, true, nil
+}
+
+func parseIgnorePatterns(patterns []string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnorePattern(pattern, "")
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// readDupeignore reads the .dupeignore file in dir, if there is one.
+func readDupeignore(dir, base string) ([]ignoreRule, error) {
+	file, err := os.Open(filepath.Join(dir, dupeignoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		rule, ok, err := parseIgnorePattern(scanner.Text(), base)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file.Name(), line, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// matches reports whether rel, a slash-separated path relative to the
+// scanned root, is matched by the rule.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	name := strings.Split(rel, "/")
+	if !r.anchored {
+		name = name[len(name)-1:]
+	}
+	return matchSegments(r.segments, name)
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// stands for any number of segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// ignored applies rules in order; as in gitignore, the last matching rule
+// decides.
+func ignored(rules []ignoreRule, rel string, isDir bool) bool {
+	result := false
+	for _, rule := range rules {
+		if rule.matches(rel, isDir) {
+			result = !rule.negate
+		}
+	}
+	return result
+}
+
+// included reports whether rules match rel or one of the directories
+// containing it.
+func included(rules []ignoreRule, rel string) bool {
+	if ignored(rules, rel, false) {
+		return true
+	}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if ignored(rules, dir, true) {
+			return true
+		}
+	}
+	return false
+}
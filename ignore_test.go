@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		base    string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"@eaDir", "", "2023/@eaDir", true, true},
+		{"*.tmp.jpg", "", "a/b/c.tmp.jpg", false, true},
+		{"*.tmp.jpg", "", "a/b/c.jpg", false, false},
+		{"node_modules/", "", "web/node_modules", true, true},
+		{"node_modules/", "", "web/node_modules", false, false},
+		{"/exports", "", "exports", true, true},
+		{"/exports", "", "2023/exports", true, false},
+		{"raw/*.png", "", "raw/a.png", false, true},
+		{"raw/*.png", "", "x/raw/a.png", false, false},
+		{"**/previews", "", "a/b/previews", true, true},
+		{"lr/**/previews", "", "lr/previews", true, true},
+		{"lr/**/previews", "", "lr/a/b/previews", true, true},
+		{"drafts", "2023", "2023/x/drafts", true, true},
+		{"drafts", "2023", "2024/drafts", true, false},
+		{"/drafts", "2023", "2023/drafts", true, true},
+		{"/drafts", "2023", "2023/x/drafts", true, false},
+		{`\#hash.jpg`, "", "#hash.jpg", false, true},
+	}
+	for _, tt := range tests {
+		rule, ok, err := parseIgnorePattern(tt.pattern, tt.base)
+		if err != nil || !ok {
+			t.Fatalf("parseIgnorePattern(%q) = %v, %v", tt.pattern, ok, err)
+		}
+		if got := rule.matches(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("%q (base %q) matches %q = %v, want %v", tt.pattern, tt.base, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnorePatternSkipsCommentsAndBlanks(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok, err := parseIgnorePattern(line, ""); ok || err != nil {
+			t.Errorf("parseIgnorePattern(%q) = %v, %v; want skipped", line, ok, err)
+		}
+	}
+	if _, _, err := parseIgnorePattern("[a-", ""); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestIgnoredLastMatchWins(t *testing.T) {
+	rules, err := parseIgnorePatterns([]string{"*.png", "!keep.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ignored(rules, "a/drop.png", false) {
+		t.Error("drop.png should be ignored")
+	}
+	if ignored(rules, "a/keep.png", false) {
+		t.Error("keep.png should be re-included")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// indexVersion is bumped whenever ScanIndex or ImageInfo changes in a way
+// older indexes cannot be read with, or in which their hashes were
+// computed differently, such as before the EXIF orientation was applied.
+const indexVersion = 6
+
+const defaultIndexPath = "image-dupes.index"
+
+// ScanIndex is the result of a scan, saved by the scan command so reports
+// can be re-rendered and acted on without rescanning.
+type ScanIndex struct {
+	Version int
+	Roots   []string
+	Created time.Time
+	Images  []ImageInfo
+}
+
+func saveIndex(path string, index ScanIndex) error {
+	index.Version = indexVersion
+	return writeGobAtomic(path, index)
+}
+
+func loadIndex(path string) (ScanIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ScanIndex{}, err
+	}
+	defer file.Close()
+
+	var index ScanIndex
+	if err := gob.NewDecoder(file).Decode(&index); err != nil {
+		return ScanIndex{}, fmt.Errorf("reading index %s: %w", path, err)
+	}
+	if index.Version != indexVersion {
+		return ScanIndex{}, fmt.Errorf("index %s has version %d, want %d; run scan again", path, index.Version, indexVersion)
+	}
+	return index, nil
+}
+
+// writeGobAtomic encodes v to a temporary file that is renamed over path, so
+// an interrupted run never leaves a corrupt file behind.
+func writeGobAtomic(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
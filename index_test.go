@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "photos.index")
+	index := ScanIndex{
+		Roots:   []string{"/photos"},
+		Created: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Images:  syntheticImageInfos(5, 1),
+	}
+
+	if err := saveIndex(path, index); err != nil {
+		t.Fatalf("saveIndex() error = %v", err)
+	}
+	loaded, err := loadIndex(path)
+	if err != nil {
+		t.Fatalf("loadIndex() error = %v", err)
+	}
+	index.Version = indexVersion
+	if !reflect.DeepEqual(loaded, index) {
+		t.Errorf("Loaded index differs from the saved one")
+	}
+}
+
+func TestLoadIndexRejectsOtherVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.index")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(file).Encode(ScanIndex{Version: indexVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, err := loadIndex(path); err == nil {
+		t.Errorf("Expected an error for an index with another version")
+	}
+	if _, err := loadIndex(filepath.Join(t.TempDir(), "missing.index")); err == nil {
+		t.Errorf("Expected an error for a missing index")
+	}
+}
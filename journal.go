@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journalVersion is written into every journal entry. Bump it on any change
+// that older undo code could misread.
+const journalVersion = 1
+
+type JournalOp string
+
+const (
+	OpMove     JournalOp = "move"
+	OpHardlink JournalOp = "hardlink"
+	OpReflink  JournalOp = "reflink"
+	OpSymlink  JournalOp = "symlink"
+)
+
+// JournalEntry records one destructive operation. It is written before the
+// operation takes effect, so an interrupted run can still be undone.
+//
+// For a move, Source is the original path and Target the new location. For
+// the link operations, Source is the duplicate replaced by a link and Target
+// the kept file it now points to. Mode and Modified are always Source's own,
+// and are restored when undoing a link.
+type JournalEntry struct {
+	Version  int         `json:"version"`
+	Op       JournalOp   `json:"op"`
+	Source   string      `json:"source"`
+	Target   string      `json:"target"`
+	MD5      string      `json:"md5"`
+	Mode     os.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	Time     time.Time   `json:"time"`
+}
+
+// Journal appends entries as JSON lines, syncing each one to disk.
+type Journal struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func defaultJournalPath(now time.Time) string {
+	return "image-dupes-journal-" + now.Format("20060102-150405") + ".jsonl"
+}
+
+func createJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Record writes entry, stamping the version and time and storing absolute
+// paths so the journal can be replayed from any directory.
+func (j *Journal) Record(entry JournalEntry) error {
+	entry.Version = journalVersion
+	entry.Source = absPath(entry.Source)
+	entry.Target = absPath(entry.Target)
+	entry.Time = time.Now().UTC()
+	if err := j.encoder.Encode(entry); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if entry.Version != journalVersion {
+			return nil, fmt.Errorf("%s:%d: unsupported journal version %d", path, line, entry.Version)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// undoJournal reverts entries newest first. A file is only restored when its
+// MD5 still matches the journal; entries that cannot be restored are reported
+// and skipped, and the returned error lists all of them.
+func undoJournal(entries []JournalEntry, hasher FileHasher, out io.Writer) (int, error) {
+	var errs []error
+	restored := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if err := undoEntry(entry, hasher); err != nil {
+			if errors.Is(err, errNeverApplied) {
+				fmt.Fprintf(out, "  skipped %s: %v\n", entry.Source, err)
+				continue
+			}
+			fmt.Fprintf(out, "  failed %s: %v\n", entry.Source, err)
+			errs = append(errs, fmt.Errorf("%s: %w", entry.Source, err))
+			continue
+		}
+		restored++
+		fmt.Fprintf(out, "  restored %s\n", entry.Source)
+	}
+	return restored, errors.Join(errs...)
+}
+
+var errNeverApplied = errors.New("operation was never applied")
+
+func undoEntry(entry JournalEntry, hasher FileHasher) error {
+	switch entry.Op {
+	case OpMove:
+		return undoMove(entry, hasher)
+	case OpHardlink, OpReflink, OpSymlink:
+		return undoLink(entry, hasher)
+	}
+	return fmt.Errorf("unknown operation %q", entry.Op)
+}
+
+func undoMove(entry JournalEntry, hasher FileHasher) error {
+	_, targetErr := os.Lstat(entry.Target)
+	_, sourceErr := os.Lstat(entry.Source)
+	if errors.Is(targetErr, os.ErrNotExist) && sourceErr == nil {
+		// The run stopped between journaling and moving
+		return errNeverApplied
+	}
+	if targetErr != nil {
+		return targetErr
+	}
+	if sourceErr == nil {
+		return fmt.Errorf("%s already exists", entry.Source)
+	}
+
+	if err := verifyMD5(entry.Target, entry.MD5, hasher); err != nil {
+		return err
+	}
+	return moveFile(entry.Target, entry.Source)
+}
+
+// undoLink replaces the link at Source with an independent copy of Target,
+// which had the same contents when the link was made.
+func undoLink(entry JournalEntry, hasher FileHasher) error {
+	applied, err := linkApplied(entry)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return errNeverApplied
+	}
+	if err := verifyMD5(entry.Target, entry.MD5, hasher); err != nil {
+		return err
+	}
+
+	tmp := tempSibling(entry.Source)
+	if err := copyFile(entry.Target, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if entry.Mode != 0 {
+		if err := os.Chmod(tmp, entry.Mode.Perm()); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if !entry.Modified.IsZero() {
+		if err := os.Chtimes(tmp, entry.Modified, entry.Modified); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, entry.Source); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkApplied reports whether Source was actually replaced by a link. A
+// reflink cannot be told apart from a copy, so it always counts as applied;
+// restoring a copy of identical bytes is harmless.
+func linkApplied(entry JournalEntry) (bool, error) {
+	info, err := os.Lstat(entry.Source)
+	if errors.Is(err, os.ErrNotExist) {
+		// Removed since; put it back
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch entry.Op {
+	case OpSymlink:
+		return info.Mode()&os.ModeSymlink != 0, nil
+	case OpHardlink:
+		target, err := os.Stat(entry.Target)
+		if err != nil {
+			return false, err
+		}
+		return os.SameFile(info, target), nil
+	}
+	return true, nil
+}
+
+func verifyMD5(path, expected string, hasher FileHasher) error {
+	hash, err := hasher.ComputeFileHash(path)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash[:]); got != expected {
+		return fmt.Errorf("%s has MD5 %s, journal recorded %s", path, got, expected)
+	}
+	return nil
+}
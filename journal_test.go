@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func moveAndJournal(t *testing.T, journal *Journal, source, target string) {
+	t.Helper()
+	hash, err := DefaultFileHasher{}.ComputeFileHash(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action := Action{Source: source, Target: target, MD5: hash}
+	if err := moveJournaled(action, journal, DefaultFileHasher{}); err != nil {
+		t.Fatalf("moveJournaled() error = %v", err)
+	}
+}
+
+func TestUndoJournal(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, filepath.Join(dir, "photos"), "a.jpg", "sub/b.jpg", "c.jpg")
+	quarantine := filepath.Join(dir, "quarantine")
+	journalPath := filepath.Join(dir, "journal.jsonl")
+
+	journal, err := createJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moveAndJournal(t, journal, paths[0], filepath.Join(quarantine, "a.jpg"))
+	moveAndJournal(t, journal, paths[1], filepath.Join(quarantine, "sub", "b.jpg"))
+	// Journaled but interrupted before the move
+	if err := journal.Record(JournalEntry{Op: OpMove, Source: paths[2], Target: filepath.Join(quarantine, "c.jpg")}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		t.Fatalf("readJournal() error = %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[1].Source != paths[1] || entries[1].Op != OpMove || entries[1].Time.IsZero() {
+		t.Errorf("Unexpected entry %+v", entries[1])
+	}
+
+	var out bytes.Buffer
+	restored, err := undoJournal(entries, DefaultFileHasher{}, &out)
+	if err != nil {
+		t.Fatalf("undoJournal() error = %v\n%s", err, out.String())
+	}
+	if restored != 2 {
+		t.Errorf("Expected 2 restored files, got %d", restored)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to be back: %v", path, err)
+		}
+	}
+}
+
+func TestUndoJournalVerifiesMD5(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "a.jpg", "b.jpg")
+	journalPath := filepath.Join(dir, "journal.jsonl")
+
+	journal, err := createJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moveAndJournal(t, journal, paths[0], filepath.Join(dir, "q", "a.jpg"))
+	moveAndJournal(t, journal, paths[1], filepath.Join(dir, "q", "b.jpg"))
+	journal.Close()
+
+	// The quarantined copy of a.jpg is modified after the move
+	if err := os.WriteFile(filepath.Join(dir, "q", "a.jpg"), []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := undoJournal(entries, DefaultFileHasher{}, &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("Expected an error for the modified file")
+	}
+	if restored != 1 {
+		t.Errorf("Expected the unmodified file to be restored, got %d", restored)
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("Modified file must not be restored")
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("Expected %s to be back: %v", paths[1], err)
+	}
+}
+
+func TestReadJournalRejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	if err := os.WriteFile(path, []byte(`{"version":99,"op":"move"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readJournal(path); err == nil {
+		t.Errorf("Expected an error for an unknown journal version")
+	}
+}
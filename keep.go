@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// KeepRule is one criterion for choosing which member of a group to keep.
+type KeepRule string
+
+const (
+	KeepResolution   KeepRule = "resolution"    // most pixels
+	KeepLargest      KeepRule = "size"          // largest file
+	KeepOldest       KeepRule = "oldest"        // earliest modification time
+	KeepShortestPath KeepRule = "shortest-path" // fewest characters in the path
+	KeepPrefix       KeepRule = "prefix"        // earliest matching -keep-prefix
+)
+
+var keepRules = []KeepRule{KeepResolution, KeepLargest, KeepOldest, KeepShortestPath, KeepPrefix}
+
+// KeepPolicy compares members rule by rule; later rules only break ties left
+// by earlier ones, and a full tie keeps the member listed first.
+type KeepPolicy struct {
+	Rules    []KeepRule
+	Prefixes []string
+}
+
+var defaultKeepPolicy = KeepPolicy{Rules: []KeepRule{KeepResolution, KeepLargest, KeepOldest}}
+
+func parseKeepPolicy(rules, prefixes string) (KeepPolicy, error) {
+	var policy KeepPolicy
+	for _, name := range strings.Split(rules, ",") {
+		rule := KeepRule(strings.ToLower(strings.TrimSpace(name)))
+		if !isKeepRule(rule) {
+			return KeepPolicy{}, fmt.Errorf("unknown keep rule %q (want %s)", name, joinKeepRules())
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	for _, prefix := range strings.Split(prefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			policy.Prefixes = append(policy.Prefixes, absPath(prefix))
+		}
+	}
+	for _, rule := range policy.Rules {
+		if rule == KeepPrefix && len(policy.Prefixes) == 0 {
+			return KeepPolicy{}, fmt.Errorf("keep rule %q needs at least one -keep-prefix", KeepPrefix)
+		}
+	}
+	return policy, nil
+}
+
+func isKeepRule(rule KeepRule) bool {
+	for _, known := range keepRules {
+		if rule == known {
+			return true
+		}
+	}
+	return false
+}
+
+func joinKeepRules() string {
+	names := make([]string, len(keepRules))
+	for i, rule := range keepRules {
+		names[i] = string(rule)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Keeper returns the index of the group member the policy keeps, chosen
+// among the members that could be removed, or -1 when none could.
+func (p KeepPolicy) Keeper(group DuplicateGroup) int {
+	return p.keeperOf(group, group.indices())
+}
+
+// keeperOf is Keeper among the given members only. A copy of a RAW file is
+// never picked, as the file itself is kept.
+func (p KeepPolicy) keeperOf(group DuplicateGroup, members []int) int {
+	best := -1
+	for _, i := range members {
+		if group.removable(i) && group.rawOriginal(i) < 0 && (best < 0 || p.compare(group.Members[i], group.Members[best]) < 0) {
+			best = i
+		}
+	}
+	return best
+}
+
+// compare returns a negative number when a should be kept over b, positive
+// when b should be kept over a, and zero on a tie.
+func (p KeepPolicy) compare(a, b GroupMember) int {
+	for _, rule := range p.Rules {
+		if c := p.compareRule(rule, a, b); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (p KeepPolicy) compareRule(rule KeepRule, a, b GroupMember) int {
+	switch rule {
+	case KeepResolution:
+		return compareInts(b.Width*b.Height, a.Width*a.Height)
+	case KeepLargest:
+		return compareInts(int(b.Size), int(a.Size))
+	case KeepOldest:
+		switch {
+		case a.ModTime.Before(b.ModTime):
+			return -1
+		case b.ModTime.Before(a.ModTime):
+			return 1
+		}
+	case KeepShortestPath:
+		return compareInts(len(a.Path), len(b.Path))
+	case KeepPrefix:
+		return compareInts(p.prefixRank(a.Path), p.prefixRank(b.Path))
+	}
+	return 0
+}
+
+// prefixRank is the position of the first prefix containing path, or
+// len(Prefixes) when none does. The prefixes are made absolute when parsed,
+// since scans store absolute paths while prefixes are often given relative.
+func (p KeepPolicy) prefixRank(path string) int {
+	path = absPath(path)
+	for i, prefix := range p.Prefixes {
+		if isWithin(path, prefix) {
+			return i
+		}
+	}
+	return len(p.Prefixes)
+}
+
+// isWithin reports whether path is dir itself or inside it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeepPolicy(t *testing.T) {
+	policy, err := parseKeepPolicy("Prefix, shortest-path", "/archive/, /photos")
+	if err != nil {
+		t.Fatalf("parseKeepPolicy() error = %v", err)
+	}
+	expected := KeepPolicy{
+		Rules:    []KeepRule{KeepPrefix, KeepShortestPath},
+		Prefixes: []string{"/archive", "/photos"},
+	}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, policy)
+	}
+
+	if _, err := parseKeepPolicy("resolution,newest", ""); err == nil {
+		t.Errorf("Expected an error for an unknown rule")
+	}
+	if _, err := parseKeepPolicy("prefix", ""); err == nil {
+		t.Errorf("Expected an error for a prefix rule without prefixes")
+	}
+}
+
+func TestKeepPolicyKeeper(t *testing.T) {
+	members := []GroupMember{
+		{ImageInfo: ImageInfo{Path: "/photos/2020/long name.jpg", Size: 30}, Width: 100, Height: 100},
+		{ImageInfo: ImageInfo{Path: "/archive/a.jpg", Size: 10}, Width: 200, Height: 200},
+		{ImageInfo: ImageInfo{Path: "/b.jpg", Size: 20}, Width: 100, Height: 100},
+	}
+
+	testCases := []struct {
+		name     string
+		policy   KeepPolicy
+		expected int
+	}{
+		{"Resolution", KeepPolicy{Rules: []KeepRule{KeepResolution}}, 1},
+		{"Size", KeepPolicy{Rules: []KeepRule{KeepLargest}}, 0},
+		{"ShortestPath", KeepPolicy{Rules: []KeepRule{KeepShortestPath}}, 2},
+		{"PrefixPriority", KeepPolicy{Rules: []KeepRule{KeepPrefix}, Prefixes: []string{"/photos", "/archive"}}, 0},
+		{"PrefixNotAPathComponent", KeepPolicy{Rules: []KeepRule{KeepPrefix, KeepShortestPath}, Prefixes: []string{"/arch"}}, 2},
+		{"TieBreak", KeepPolicy{Rules: []KeepRule{KeepPrefix, KeepLargest}, Prefixes: []string{"/nowhere"}}, 0},
+		{"NoRules", KeepPolicy{}, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.Keeper(DuplicateGroup{Members: members}); got != tc.expected {
+				t.Errorf("Expected keeper %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestKeepPrefixRelative(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := parseKeepPolicy("prefix", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scans store absolute paths
+	group := DuplicateGroup{Members: []GroupMember{
+		{ImageInfo: ImageInfo{Path: filepath.Join(wd, "incoming", "a.jpg")}},
+		{ImageInfo: ImageInfo{Path: filepath.Join(wd, "archive", "a.jpg")}},
+	}}
+	if got := policy.Keeper(group); got != 1 {
+		t.Errorf("Expected the relative prefix to match the absolute archive path, got keeper %d", got)
+	}
+}
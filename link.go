@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errAlreadyLinked      = errors.New("already linked to the kept file")
+	errReflinkUnsupported = errors.New("reflinks are not supported on this filesystem")
+)
+
+var linkModes = map[string]JournalOp{
+	"hard":    OpHardlink,
+	"reflink": OpReflink,
+	"symlink": OpSymlink,
+}
+
+func parseLinkMode(s string) (JournalOp, error) {
+	op, ok := linkModes[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return "", fmt.Errorf("unknown link mode %q (want hard, reflink or symlink)", s)
+	}
+	return op, nil
+}
+
+// planLinks picks a keeper among every set of byte-identical copies and
+// plans to replace each other copy with a link to it. Visually similar
+// members are skipped, since their files differ.
+func planLinks(groups []DuplicateGroup, policy KeepPolicy, op JournalOp) []Action {
+	var actions []Action
+	for _, group := range groups {
+		planGroup(group, policy, map[MatchKind]bool{MatchIdentical: true}, func(keep, i int, kind MatchKind) {
+			actions = append(actions, Action{
+				GroupID: group.ID,
+				Op:      op,
+				Keep:    group.Members[keep].Path,
+				Source:  group.Members[i].Path,
+				Target:  group.Members[keep].Path,
+				MD5:     group.Members[i].FileHash,
+			})
+		})
+	}
+	return actions
+}
+
+// linkJournaled replaces action.Source with a link to action.Keep after a
+// full byte comparison. The link is built next to the source and renamed
+// over it, so the source is never missing; the journal entry is written
+// between the two steps.
+func linkJournaled(action Action, journal *Journal) error {
+	info, err := os.Lstat(action.Source)
+	if err != nil {
+		return err
+	}
+	keepInfo, err := os.Stat(action.Keep)
+	if err != nil {
+		return err
+	}
+	if target, err := os.Stat(action.Source); err == nil && os.SameFile(target, keepInfo) {
+		return errAlreadyLinked
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if action.Op == OpHardlink {
+		same, err := sameDevice(info, keepInfo)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("hardlinks cannot cross filesystems (kept file is %s)", action.Keep)
+		}
+	}
+
+	equal, hash, err := compareFiles(action.Source, action.Keep)
+	if err != nil {
+		return err
+	}
+	if !equal {
+		return fmt.Errorf("contents differ from %s", action.Keep)
+	}
+
+	tmp := tempSibling(action.Source)
+	if err := createLink(action.Op, action.Keep, tmp, info); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	entry := JournalEntry{
+		Op:       action.Op,
+		Source:   action.Source,
+		Target:   action.Keep,
+		MD5:      hex.EncodeToString(hash[:]),
+		Mode:     info.Mode(),
+		Modified: info.ModTime(),
+	}
+	if err := journal.Record(entry); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := os.Rename(tmp, action.Source); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// createLink makes path a link of the given kind to keep. A reflink is a
+// separate file, so it also gets the replaced file's mode and times.
+func createLink(op JournalOp, keep, path string, replaced os.FileInfo) error {
+	switch op {
+	case OpHardlink:
+		return os.Link(keep, path)
+	case OpSymlink:
+		return os.Symlink(absPath(keep), path)
+	case OpReflink:
+		if err := reflinkFile(keep, path); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, replaced.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(path, replaced.ModTime(), replaced.ModTime())
+	}
+	return fmt.Errorf("unknown link operation %q", op)
+}
+
+// tempSibling names a temporary file in the same directory as path, so it
+// can be renamed over path atomically.
+func tempSibling(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".image-dupes-tmp")
+}
+
+// compareFiles reports whether a and b have identical contents, along with
+// the MD5 of a.
+func compareFiles(a, b string) (bool, [16]byte, error) {
+	var hash [16]byte
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, hash, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, hash, err
+	}
+	defer fb.Close()
+
+	h := md5.New()
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, hash, errA
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, hash, errB
+		}
+		h.Write(bufA[:na])
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, hash, nil
+		}
+		if errA != nil || errB != nil {
+			// Equal chunks, so both files ended together
+			copy(hash[:], h.Sum(nil))
+			return true, hash, nil
+		}
+	}
+}
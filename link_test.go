@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareFiles(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024/16)
+	files := map[string][]byte{
+		"a":      []byte("same"),
+		"b":      []byte("same"),
+		"c":      []byte("diff"),
+		"short":  []byte("sam"),
+		"large":  large,
+		"large2": append(append([]byte{}, large...), 'x'),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"a", "b", true},
+		{"a", "c", false},
+		{"a", "short", false},
+		{"short", "a", false},
+		{"large", "large", true},
+		{"large", "large2", false},
+	}
+
+	for _, tc := range testCases {
+		equal, hash, err := compareFiles(filepath.Join(dir, tc.a), filepath.Join(dir, tc.b))
+		if err != nil {
+			t.Fatalf("compareFiles(%s, %s) error = %v", tc.a, tc.b, err)
+		}
+		if equal != tc.expected {
+			t.Errorf("compareFiles(%s, %s) = %v, expected %v", tc.a, tc.b, equal, tc.expected)
+		}
+		if expected, _ := (DefaultFileHasher{}).ComputeFileHash(filepath.Join(dir, tc.a)); equal && hash != expected {
+			t.Errorf("compareFiles(%s, %s) returned the wrong MD5", tc.a, tc.b)
+		}
+	}
+}
+
+func TestPlanLinksSkipsPerceptualGroups(t *testing.T) {
+	groups := sampleGroups()
+	actions := planLinks(groups, defaultKeepPolicy, OpHardlink)
+	if len(actions) != 1 {
+		t.Fatalf("Expected one action, got %+v", actions)
+	}
+	if actions[0].Op != OpHardlink || actions[0].Target != actions[0].Keep || actions[0].GroupID != 1 {
+		t.Errorf("Unexpected action %+v", actions[0])
+	}
+
+	if _, err := parseLinkMode("junction"); err == nil {
+		t.Errorf("Expected an error for an unknown link mode")
+	}
+}
+
+func TestLinkAndUndo(t *testing.T) {
+	for _, op := range []JournalOp{OpHardlink, OpSymlink, OpReflink} {
+		t.Run(string(op), func(t *testing.T) {
+			dir := t.TempDir()
+			paths := writeFiles(t, dir, "keep.jpg", "album/dupe.jpg")
+			if err := os.WriteFile(paths[1], []byte("keep.jpg"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := os.Stat(paths[1])
+
+			journalPath := filepath.Join(dir, "journal.jsonl")
+			journal, err := createJournal(journalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions := []Action{{GroupID: 1, Op: op, Keep: paths[0], Source: paths[1], Target: paths[0]}}
+			var out bytes.Buffer
+			done, err := executeActions(actions, false, &out, journal, DefaultFileHasher{})
+			journal.Close()
+			if err != nil {
+				t.Fatalf("executeActions() error = %v", err)
+			}
+			if done == 0 {
+				// Only reflinks may be skipped, and then nothing changes
+				if op != OpReflink || !strings.Contains(out.String(), "skipped") {
+					t.Fatalf("Expected %s to be applied, got %q", op, out.String())
+				}
+				return
+			}
+
+			keepInfo, _ := os.Stat(paths[0])
+			dupeInfo, err := os.Stat(paths[1])
+			if err != nil {
+				t.Fatalf("Duplicate path must still resolve: %v", err)
+			}
+			if linked := os.SameFile(keepInfo, dupeInfo); linked != (op != OpReflink) {
+				t.Errorf("Expected SameFile = %v after %s", op != OpReflink, op)
+			}
+
+			entries, err := readJournal(journalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := undoJournal(entries, DefaultFileHasher{}, &out); err != nil {
+				t.Fatalf("undoJournal() error = %v", err)
+			}
+			after, err := os.Lstat(paths[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !after.Mode().IsRegular() || os.SameFile(after, keepInfo) {
+				t.Errorf("Expected an independent file after undo")
+			}
+			if after.Mode().Perm() != before.Mode().Perm() || !after.ModTime().Equal(before.ModTime()) {
+				t.Errorf("Expected mode %v and time %v to be restored, got %v and %v", before.Mode(), before.ModTime(), after.Mode(), after.ModTime())
+			}
+			if content, _ := os.ReadFile(paths[1]); string(content) != "keep.jpg" {
+				t.Errorf("Unexpected contents after undo: %q", content)
+			}
+		})
+	}
+}
+
+func TestLinkRefusesDifferentContents(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "keep.jpg", "dupe.jpg")
+	journal, err := createJournal(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	err = linkJournaled(Action{Op: OpHardlink, Keep: paths[0], Source: paths[1], Target: paths[0]}, journal)
+	if err == nil || !strings.Contains(err.Error(), "contents differ") {
+		t.Errorf("Expected a content mismatch error, got %v", err)
+	}
+	if content, _ := os.ReadFile(paths[1]); string(content) != "dupe.jpg" {
+		t.Errorf("Duplicate must be left untouched")
+	}
+}
+
+func TestLinkSkipsExistingLinks(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "keep.jpg")
+	dupe := filepath.Join(dir, "dupe.jpg")
+	if err := os.Link(paths[0], dupe); err != nil {
+		t.Fatal(err)
+	}
+
+	err := linkJournaled(Action{Op: OpHardlink, Keep: paths[0], Source: dupe, Target: paths[0]}, nil)
+	if err != errAlreadyLinked {
+		t.Errorf("Expected errAlreadyLinked, got %v", err)
+	}
+}
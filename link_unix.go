@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func sameDevice(a, b os.FileInfo) (bool, error) {
+	sa, okA := a.Sys().(*syscall.Stat_t)
+	sb, okB := b.Sys().(*syscall.Stat_t)
+	if !okA || !okB {
+		return false, fmt.Errorf("cannot read the device of %s", a.Name())
+	}
+	return sa.Dev == sb.Dev, nil
+}
@@ -4,67 +4,103 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"time"
-
-	"github.com/briandowns/spinner"
+	"strings"
 )
 
-func main() {
-	rootDir := flag.String("dir", "", "Root directory to scan for images")
-	outputHTML := flag.String("output", "report.html", "Output HTML file name")
-	flag.Parse()
+// statusOut receives progress and status messages. It moves to stderr when
+// a report is written to stdout, so the report can be piped.
+var statusOut = os.Stdout
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
 
-	if *rootDir == "" {
-		fmt.Println("Please specify a root directory using -dir flag")
-		flag.PrintDefaults()
-		os.Exit(1)
+func main() {
+	commands := []command{
+		{"scan", "Scan a directory and save an index of image hashes", runScan},
+		{"report", "Write reports of the duplicate groups in an index or directory", runReport},
+		{"apply", "Quarantine or link duplicates, keeping one file per group", runApply},
+		{"compare", "Find incoming images already in an archive, and list or import the new ones", runCompare},
+		{"serve", "Review duplicate groups in the browser", runServe},
+		{"undo", "Revert the changes recorded in a journal", runUndo},
 	}
 
-	// Scanning directory
-	fmt.Println("Scanning directory for images...")
-	images, err := scanDirectoryRecursive(*rootDir)
-	if err != nil {
-		fmt.Printf("Error scanning directory: %v\n", err)
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		name := os.Args[1]
+		for _, cmd := range commands {
+			if cmd.name == name {
+				os.Exit(cmd.run(os.Args[2:]))
+			}
+		}
+		if name != "help" {
+			fmt.Printf("Unknown command %q\n\n", name)
+		}
+		printCommands(commands)
+		if name != "help" {
+			os.Exit(2)
+		}
 		return
 	}
-	fmt.Printf("Found %d images\n", len(images))
 
-	// Computing hashes
-	fmt.Println("Computing image hashes...")
-	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
-	s.Start()
+	// Without a command, scan, report and act in one go
+	os.Exit(runAll(os.Args[1:]))
+}
 
-	progressChan := make(chan string)
-	go func() {
-		for msg := range progressChan {
-			s.Suffix = " " + msg
-		}
-	}()
+func printCommands(commands []command) {
+	fmt.Println("Usage: image-dupes <command> [flags]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Println()
+	fmt.Println("Run \"image-dupes <command> -h\" for the flags of a command, or")
+	fmt.Println("\"image-dupes -dir <directory> [flags]\" to scan and report in one step.")
+}
 
-	imageInfos, err := computeHashes(images, progressChan, DefaultImageOpener{}, DefaultIconCreator{}, DefaultFileHasher{})
-	s.Stop()
-	close(progressChan)
+// newFlagSet creates the FlagSet of a command, whose usage starts with the
+// given synopsis.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: image-dupes %s\n\nFlags:\n", synopsis)
+		flags.PrintDefaults()
+	}
+	return flags
+}
 
-	if err != nil {
-		fmt.Printf("Error computing hashes: %v\n", err)
-		return
+// usageError prints err with the command's usage and returns the exit code.
+func usageError(flags *flag.FlagSet, err error) int {
+	fmt.Fprintln(flags.Output(), err)
+	flags.Usage()
+	return 2
+}
+
+func openHashCache(path string, disabled, rebuild bool) *HashCache {
+	if disabled {
+		return nil
+	}
+
+	if path == "" {
+		var err error
+		path, err = defaultCachePath()
+		if err != nil {
+			fmt.Fprintf(statusOut, "Hash cache disabled: %v\n", err)
+			return nil
+		}
 	}
-	fmt.Printf("Computed hashes for %d images\n", len(imageInfos))
 
-	// Finding similar images
-	fmt.Println("Finding similar images...")
-	similarGroups := findSimilarImages(imageInfos)
-	fmt.Printf("Found %d groups of similar images\n", len(similarGroups))
+	if rebuild {
+		return newHashCache(path)
+	}
 
-	// Generating HTML report
-	fmt.Println("Generating HTML report...")
-	s.Suffix = ""
-	s.Start()
-	err = generateHTMLReport(similarGroups, *outputHTML)
-	s.Stop()
+	cache, err := loadHashCache(path)
 	if err != nil {
-		fmt.Printf("Error generating HTML report: %v\n", err)
-		return
+		fmt.Fprintf(statusOut, "Ignoring unreadable hash cache: %v\n", err)
+		return newHashCache(path)
 	}
-	fmt.Printf("HTML report generated: %s\n", *outputHTML)
+	fmt.Fprintf(statusOut, "Loaded %d cached hashes from %s\n", cache.Len(), path)
+	return cache
 }
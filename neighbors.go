@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// Default images4.Similar thresholds, mirrored here because images4 keeps
+// them unexported. Luma distance is squared and scaled by 1/255².
+const (
+	defaultLumaThreshold       = float64(images4.IconSize*images4.IconSize) * 50 * 50 * 0.2
+	defaultChromaThreshold     = defaultLumaThreshold * 2
+	defaultProportionThreshold = 0.05
+)
+
+const (
+	iconPixels = images4.IconSize * images4.IconSize
+	numPivots  = 4
+	// Guards the triangle-inequality bounds against float rounding so the
+	// index never drops a pair that images4.Similar would accept.
+	pivotSlack = 1e-6
+)
+
+// neighborIndex narrows down which images can possibly pass images4.Similar
+// so the full comparison only runs on plausible candidates.
+//
+// Each icon's luma channel is treated as a point in Euclidean space. Its
+// distance to a handful of pivot icons is precomputed, and by the triangle
+// inequality two icons within the luma threshold of each other must also be
+// within that distance on every pivot. Images are sorted by their distance
+// to the first pivot so candidates come from a narrow window, which is then
+// filtered by the remaining pivots and by aspect ratio. The filter is exact:
+// it never rejects a pair that the full check would accept.
+type neighborIndex struct {
+	images      []ImageInfo
+	radius      float64
+	maxLogRatio float64
+	keys        [][numPivots]float64
+	logAspect   []float64
+	valid       []bool
+	order       []int // image indices sorted by keys[i][0]
+	sortedKeys  []float64
+}
+
+func newNeighborIndex(images []ImageInfo, lumaThreshold, proportionThreshold float64) *neighborIndex {
+	idx := &neighborIndex{
+		images:    images,
+		radius:    math.Sqrt(lumaThreshold) + pivotSlack,
+		keys:      make([][numPivots]float64, len(images)),
+		logAspect: make([]float64, len(images)),
+		valid:     make([]bool, len(images)),
+	}
+	// PropMetric(a, b) = |ra-rb|/max(ra,rb) for r = height/width, which is
+	// below the threshold exactly when the log ratios differ by less than
+	// -log(1-threshold).
+	if proportionThreshold >= 1 {
+		idx.maxLogRatio = math.Inf(1)
+	} else {
+		idx.maxLogRatio = -math.Log(1-proportionThreshold) + pivotSlack
+	}
+
+	for i, img := range images {
+		size := img.Icon.ImgSize
+		// Images without dimensions or a full icon can never be similar.
+		idx.valid[i] = size.X > 0 && size.Y > 0 && len(img.Icon.Pixels) >= iconPixels
+		if idx.valid[i] {
+			idx.logAspect[i] = math.Log(float64(size.Y) / float64(size.X))
+		}
+	}
+
+	pivots := idx.choosePivots()
+	for i := range images {
+		if !idx.valid[i] {
+			continue
+		}
+		for p, pivot := range pivots {
+			idx.keys[i][p] = lumaDistance(images[i].Icon, images[pivot].Icon)
+		}
+	}
+
+	for i := range images {
+		if idx.valid[i] {
+			idx.order = append(idx.order, i)
+		}
+	}
+	sort.SliceStable(idx.order, func(a, b int) bool {
+		return idx.keys[idx.order[a]][0] < idx.keys[idx.order[b]][0]
+	})
+	idx.sortedKeys = make([]float64, len(idx.order))
+	for n, i := range idx.order {
+		idx.sortedKeys[n] = idx.keys[i][0]
+	}
+
+	return idx
+}
+
+// choosePivots picks spread-out icons with the farthest-first heuristic.
+// Pivots are reused when there are fewer valid icons than numPivots.
+func (idx *neighborIndex) choosePivots() [numPivots]int {
+	var pivots [numPivots]int
+	first := -1
+	for i, ok := range idx.valid {
+		if ok {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return pivots
+	}
+
+	minDist := make([]float64, len(idx.images))
+	for i := range minDist {
+		minDist[i] = math.Inf(1)
+	}
+	pivots[0] = first
+	for p := 1; p < numPivots; p++ {
+		best, bestDist := pivots[p-1], -1.0
+		for i := range idx.images {
+			if !idx.valid[i] {
+				continue
+			}
+			d := lumaDistance(idx.images[i].Icon, idx.images[pivots[p-1]].Icon)
+			if d < minDist[i] {
+				minDist[i] = d
+			}
+			if minDist[i] > bestDist {
+				best, bestDist = i, minDist[i]
+			}
+		}
+		pivots[p] = best
+	}
+	return pivots
+}
+
+// Candidates returns, in ascending order, the indices of images that may be
+// similar to image i. Image i itself is not included.
+func (idx *neighborIndex) Candidates(i int) []int {
+	if !idx.valid[i] {
+		return nil
+	}
+
+	key := idx.keys[i]
+	lo := sort.SearchFloat64s(idx.sortedKeys, key[0]-idx.radius)
+
+	var candidates []int
+	for n := lo; n < len(idx.order) && idx.sortedKeys[n] <= key[0]+idx.radius; n++ {
+		j := idx.order[n]
+		if j == i || math.Abs(idx.logAspect[i]-idx.logAspect[j]) > idx.maxLogRatio {
+			continue
+		}
+		if withinPivotBounds(key, idx.keys[j], idx.radius) {
+			candidates = append(candidates, j)
+		}
+	}
+	sort.Ints(candidates)
+	return candidates
+}
+
+func withinPivotBounds(a, b [numPivots]float64, radius float64) bool {
+	for p := 1; p < numPivots; p++ {
+		if math.Abs(a[p]-b[p]) > radius {
+			return false
+		}
+	}
+	return true
+}
+
+// lumaDistance is the square root of the first images4.EucMetric component.
+func lumaDistance(a, b images4.IconT) float64 {
+	var sum float64
+	for i := 0; i < iconPixels; i++ {
+		d := float64(a.Pixels[i]) - float64(b.Pixels[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum) / 255
+}
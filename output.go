@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reportSchemaVersion is written into every JSON and NDJSON document. Bump it
+// on any incompatible change to the jsonGroup or jsonMember layout and
+// document the change in README.md.
+const reportSchemaVersion = 1
+
+type OutputFormat string
+
+const (
+	FormatHTML   OutputFormat = "html"
+	FormatJSON   OutputFormat = "json"
+	FormatNDJSON OutputFormat = "ndjson"
+	FormatCSV    OutputFormat = "csv"
+)
+
+var outputFormats = []OutputFormat{FormatHTML, FormatJSON, FormatNDJSON, FormatCSV}
+
+type jsonReport struct {
+	SchemaVersion int         `json:"schema_version"`
+	GeneratedAt   time.Time   `json:"generated_at"`
+	Groups        []jsonGroup `json:"groups"`
+}
+
+type jsonGroup struct {
+	// Only set on NDJSON lines, where there is no enclosing document
+	SchemaVersion int          `json:"schema_version,omitempty"`
+	ID            int          `json:"id"`
+	Kind          MatchKind    `json:"kind"`
+	Members       []jsonMember `json:"members"`
+}
+
+type jsonMember struct {
+	Path     string    `json:"path"`
+	MD5      string    `json:"md5"`
+	Size     int64     `json:"size"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Modified time.Time `json:"modified"`
+	Match    MatchKind `json:"match"`
+	Score    float64   `json:"score"`
+	// Only set with -match-transforms, on rotated or mirrored copies
+	Transform Transform `json:"transform,omitempty"`
+	// Only set on crops, in the representative's pixels
+	Region *jsonRegion `json:"region,omitempty"`
+	// Only set with -ensemble, for the algorithms both images have
+	Distances map[HashAlgorithm]float64 `json:"distances,omitempty"`
+}
+
+type jsonRegion struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func newJSONGroup(group DuplicateGroup) jsonGroup {
+	result := jsonGroup{ID: group.ID, Kind: group.Kind, Members: make([]jsonMember, len(group.Members))}
+	for i, member := range group.Members {
+		result.Members[i] = jsonMember{
+			Path:      member.Path,
+			MD5:       hex.EncodeToString(member.FileHash[:]),
+			Size:      member.Size,
+			Width:     member.Width,
+			Height:    member.Height,
+			Modified:  member.ModTime,
+			Match:     member.Kind,
+			Score:     member.Score,
+			Transform: member.Transform,
+		}
+		if r := member.Region; !r.Empty() {
+			result.Members[i].Region = &jsonRegion{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}
+		}
+		for algorithm, d := range member.Distances {
+			// JSON has no infinity, which stands for a missing hash
+			if math.IsInf(d, 0) {
+				continue
+			}
+			if result.Members[i].Distances == nil {
+				result.Members[i].Distances = make(map[HashAlgorithm]float64)
+			}
+			result.Members[i].Distances[algorithm] = d
+		}
+	}
+	return result
+}
+
+// parseFormats reads a comma-separated list of output formats.
+func parseFormats(s string) ([]OutputFormat, error) {
+	var formats []OutputFormat
+	seen := make(map[OutputFormat]bool)
+	for _, name := range strings.Split(s, ",") {
+		format := OutputFormat(strings.ToLower(strings.TrimSpace(name)))
+		if !isOutputFormat(format) {
+			return nil, fmt.Errorf("unknown output format %q (want %s)", name, joinFormats(outputFormats))
+		}
+		if !seen[format] {
+			seen[format] = true
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+func isOutputFormat(format OutputFormat) bool {
+	for _, known := range outputFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+func joinFormats(formats []OutputFormat) string {
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = string(format)
+	}
+	return strings.Join(names, ", ")
+}
+
+// outputPath derives the file for one format from the -output flag: a known
+// format extension is swapped for the format's own, so "report.html" becomes
+// "report.json". "-" means standard output.
+func outputPath(base string, format OutputFormat) string {
+	if base == "-" {
+		return base
+	}
+	ext := filepath.Ext(base)
+	if isOutputFormat(OutputFormat(strings.ToLower(strings.TrimPrefix(ext, ".")))) {
+		return strings.TrimSuffix(base, ext) + "." + string(format)
+	}
+	return base + "." + string(format)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// createOutput opens a report destination; "-" writes to standard output.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+func generateJSONReport(groups []DuplicateGroup, outputFile string) error {
+	file, err := createOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	report := jsonReport{SchemaVersion: reportSchemaVersion, GeneratedAt: time.Now().UTC(), Groups: make([]jsonGroup, len(groups))}
+	for i, group := range groups {
+		report.Groups[i] = newJSONGroup(group)
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// ndjsonWriter streams one group per line as soon as it is found.
+type ndjsonWriter struct {
+	out     io.WriteCloser
+	encoder *json.Encoder
+	err     error
+}
+
+func newNDJSONWriter(outputFile string) (*ndjsonWriter, error) {
+	out, err := createOutput(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonWriter{out: out, encoder: json.NewEncoder(out)}, nil
+}
+
+// WriteGroup keeps the first error and ignores later groups, so it can be
+// used directly as a SimilarityOptions.OnGroup callback.
+func (w *ndjsonWriter) WriteGroup(group DuplicateGroup) {
+	if w.err != nil {
+		return
+	}
+	line := newJSONGroup(group)
+	line.SchemaVersion = reportSchemaVersion
+	w.err = w.encoder.Encode(line)
+}
+
+func (w *ndjsonWriter) Close() error {
+	if err := w.out.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sampleGroups() []DuplicateGroup {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return []DuplicateGroup{
+		{ID: 1, Kind: MatchIdentical, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/photos/a.jpg", FileHash: [16]byte{0xab, 0xcd}, Size: 1000, ModTime: modified}, Width: 640, Height: 480, Kind: MatchIdentical},
+			{ImageInfo: ImageInfo{Path: "/photos/copy of a.jpg", FileHash: [16]byte{0xab, 0xcd}, Size: 1000, ModTime: modified}, Width: 640, Height: 480, Kind: MatchIdentical},
+		}},
+		{ID: 2, Kind: MatchPerceptual, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/photos/b.png", Size: 2000, ModTime: modified}, Width: 100, Height: 50, Kind: MatchPerceptual},
+			{ImageInfo: ImageInfo{Path: "/photos/b#small.jpg", Size: 300, ModTime: modified}, Width: 50, Height: 25, Kind: MatchPerceptual, Score: 0.5},
+		}},
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	testCases := []struct {
+		input     string
+		expected  []OutputFormat
+		expectErr bool
+	}{
+		{"html", []OutputFormat{FormatHTML}, false},
+		{"json,ndjson", []OutputFormat{FormatJSON, FormatNDJSON}, false},
+		{" JSON , html ,json", []OutputFormat{FormatJSON, FormatHTML}, false},
+		{"xml", nil, true},
+		{"", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := parseFormats(tc.input)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("parseFormats(%q) error = %v, expectErr %v", tc.input, err, tc.expectErr)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("parseFormats(%q) = %v, expected %v", tc.input, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	testCases := []struct {
+		base     string
+		format   OutputFormat
+		expected string
+	}{
+		{"report.html", FormatHTML, "report.html"},
+		{"report.html", FormatJSON, "report.json"},
+		{"out/dupes.JSON", FormatNDJSON, "out/dupes.ndjson"},
+		{"dupes", FormatJSON, "dupes.json"},
+		{"-", FormatNDJSON, "-"},
+	}
+
+	for _, tc := range testCases {
+		if got := outputPath(tc.base, tc.format); got != tc.expected {
+			t.Errorf("outputPath(%q, %s) = %q, expected %q", tc.base, tc.format, got, tc.expected)
+		}
+	}
+}
+
+func TestGenerateJSONReport(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "report.json")
+	if err := generateJSONReport(sampleGroups(), outputFile); err != nil {
+		t.Fatalf("generateJSONReport() error = %v", err)
+	}
+
+	content, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read JSON report: %v", err)
+	}
+
+	var report jsonReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatalf("Report is not valid JSON: %v", err)
+	}
+	if report.SchemaVersion != reportSchemaVersion {
+		t.Errorf("Expected schema version %d, got %d", reportSchemaVersion, report.SchemaVersion)
+	}
+	if len(report.Groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(report.Groups))
+	}
+
+	first := report.Groups[0]
+	if first.ID != 1 || first.Kind != MatchIdentical || first.SchemaVersion != 0 {
+		t.Errorf("Unexpected first group header: %+v", first)
+	}
+	expected := jsonMember{
+		Path:     "/photos/a.jpg",
+		MD5:      "abcd0000000000000000000000000000",
+		Size:     1000,
+		Width:    640,
+		Height:   480,
+		Modified: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Match:    MatchIdentical,
+	}
+	if !reflect.DeepEqual(first.Members[0], expected) {
+		t.Errorf("Expected member %+v, got %+v", expected, first.Members[0])
+	}
+	if report.Groups[1].Members[1].Score != 0.5 {
+		t.Errorf("Expected score 0.5, got %v", report.Groups[1].Members[1].Score)
+	}
+
+	t.Run("EmptyGroups", func(t *testing.T) {
+		outputFile := filepath.Join(t.TempDir(), "empty.json")
+		if err := generateJSONReport(nil, outputFile); err != nil {
+			t.Fatalf("generateJSONReport() error = %v", err)
+		}
+		var report map[string]interface{}
+		content, _ := os.ReadFile(outputFile)
+		if err := json.Unmarshal(content, &report); err != nil {
+			t.Fatalf("Report is not valid JSON: %v", err)
+		}
+		if groups, ok := report["groups"].([]interface{}); !ok || len(groups) != 0 {
+			t.Errorf("Expected an empty groups array, got %v", report["groups"])
+		}
+	})
+
+	t.Run("InvalidPath", func(t *testing.T) {
+		if err := generateJSONReport(sampleGroups(), "/invalid/path/report.json"); err == nil {
+			t.Errorf("Expected an error for an invalid output path")
+		}
+	})
+}
+
+func TestNDJSONWriter(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "report.ndjson")
+	writer, err := newNDJSONWriter(outputFile)
+	if err != nil {
+		t.Fatalf("newNDJSONWriter() error = %v", err)
+	}
+	for _, group := range sampleGroups() {
+		writer.WriteGroup(group)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	file, err := os.Open(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to open NDJSON output: %v", err)
+	}
+	defer file.Close()
+
+	var lines []jsonGroup
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var group jsonGroup
+		if err := json.Unmarshal(scanner.Bytes(), &group); err != nil {
+			t.Fatalf("Line %d is not valid JSON: %v", len(lines)+1, err)
+		}
+		lines = append(lines, group)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d", len(lines))
+	}
+	for i, group := range lines {
+		if group.SchemaVersion != reportSchemaVersion {
+			t.Errorf("Line %d: expected schema version %d, got %d", i+1, reportSchemaVersion, group.SchemaVersion)
+		}
+		if group.ID != i+1 {
+			t.Errorf("Line %d: expected group ID %d, got %d", i+1, i+1, group.ID)
+		}
+	}
+	if lines[1].Members[1].Path != "/photos/b#small.jpg" {
+		t.Errorf("Unexpected path %q", lines[1].Members[1].Path)
+	}
+}
+
+func TestFindSimilarImagesStreamsGroups(t *testing.T) {
+	infos := append(chainImageInfos(),
+		ImageInfo{Path: "/dup1.jpg", FileHash: [16]byte{9}, Icon: flatIcon(30000)},
+		ImageInfo{Path: "/dup2.jpg", FileHash: [16]byte{9}, Icon: flatIcon(30000)},
+	)
+
+	var streamed []DuplicateGroup
+	groups := findSimilarImages(infos, SimilarityOptions{
+		Grouping: GroupingTransitive,
+		OnGroup:  func(group DuplicateGroup) { streamed = append(streamed, group) },
+	})
+
+	if !reflect.DeepEqual(streamed, groups) {
+		t.Errorf("Streamed groups %v differ from returned groups %v", streamed, groups)
+	}
+	if len(groups) != 2 || groups[0].Kind != MatchIdentical || groups[1].Kind != MatchPerceptual {
+		t.Errorf("Expected an identical group followed by a perceptual group, got %v", groups)
+	}
+}
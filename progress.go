@@ -17,6 +17,15 @@ func (p *Progress) Increment() {
 	p.processedFiles++
 }
 
+// IncrementAndGet records one processed file and returns the updated counts
+// atomically, so concurrent workers never report the same position twice.
+func (p *Progress) IncrementAndGet() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processedFiles++
+	return p.processedFiles, p.totalFiles
+}
+
 func (p *Progress) GetProgress() (int, int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -33,6 +33,36 @@ func TestProgressGetProgress(t *testing.T) {
 	}
 }
 
+func TestProgressIncrementAndGet(t *testing.T) {
+	p := &Progress{totalFiles: 100}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processed, total := p.IncrementAndGet()
+			if total != 100 {
+				t.Errorf("Expected total 100, got %d", total)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[processed] {
+				t.Errorf("Position %d reported more than once", processed)
+			}
+			seen[processed] = true
+		}()
+	}
+
+	wg.Wait()
+
+	if len(seen) != 100 {
+		t.Errorf("Expected 100 distinct positions, got %d", len(seen))
+	}
+}
+
 func TestProgressConcurrency(t *testing.T) {
 	p := &Progress{totalFiles: 1000}
 	var wg sync.WaitGroup
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+)
+
+// rawFormat is the format name of camera RAW files. They are TIFF-based
+// containers, and only their embedded JPEG previews are compared.
+const rawFormat = "raw"
+
+// TIFF tags used to find embedded previews
+const (
+	tagCompression      = 0x0103
+	tagStripOffsets     = 0x0111
+	tagStripByteCounts  = 0x0117
+	tagSubIFDs          = 0x014a
+	tagJPEGOffset       = 0x0201
+	tagJPEGLength       = 0x0202
+	tiffCompressionJPEG = 6
+	tiffCompressionDNG  = 7
+	// maxIFDs bounds the walk through a malformed or looping file
+	maxIFDs = 64
+)
+
+var errNoRawPreview = errors.New("no embedded JPEG preview found")
+
+// RawImageOpener opens camera RAW files (CR2, NEF, ARW, DNG) by decoding
+// the largest JPEG preview embedded in them, and hands every other file to
+// Next.
+type RawImageOpener struct {
+	Next ImageOpener
+}
+
+func (o RawImageOpener) Open(path string) (image.Image, error) {
+	if extensionFormat(path) != rawFormat {
+		return o.Next.Open(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	preview, err := largestRawPreview(file)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(preview)
+	if err != nil {
+		return nil, err
+	}
+	// Previews are stored as the sensor saw them; the orientation is on
+	// the RAW file
+	return orientImage(img, exifOrientation(file)), nil
+}
+
+// isRawFile reports whether path has a camera RAW extension.
+func isRawFile(path string) bool {
+	return extensionFormat(path) == rawFormat
+}
+
+// largestRawPreview walks every IFD of a TIFF-based RAW file, including
+// SubIFDs, and returns the embedded JPEG with the most pixels. Candidates
+// the standard decoder cannot read, such as DNG's lossless JPEG raw data,
+// are skipped.
+func largestRawPreview(r io.ReaderAt) (*io.SectionReader, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF-based RAW file")
+	}
+
+	var best *io.SectionReader
+	bestPixels := 0
+	consider := func(offset, length int64) {
+		if offset <= 0 || length <= 0 {
+			return
+		}
+		section := io.NewSectionReader(r, offset, length)
+		config, err := jpeg.DecodeConfig(section)
+		if err != nil {
+			return
+		}
+		if pixels := config.Width * config.Height; pixels > bestPixels {
+			best, bestPixels = io.NewSectionReader(r, offset, length), pixels
+		}
+	}
+
+	queue := []int64{int64(order.Uint32(header[4:]))}
+	visited := make(map[int64]bool)
+	for len(queue) > 0 && len(visited) < maxIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset <= 0 || visited[offset] {
+			continue
+		}
+		visited[offset] = true
+
+		ifd, next, err := readIFD(r, order, offset)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, next)
+		queue = append(queue, ifd[tagSubIFDs]...)
+
+		if jpegOffset, length := ifd[tagJPEGOffset], ifd[tagJPEGLength]; len(jpegOffset) == 1 && len(length) == 1 {
+			consider(jpegOffset[0], length[0])
+		}
+		if compression := ifd[tagCompression]; len(compression) == 1 && (compression[0] == tiffCompressionJPEG || compression[0] == tiffCompressionDNG) {
+			if strips, counts := ifd[tagStripOffsets], ifd[tagStripByteCounts]; len(strips) == 1 && len(counts) == 1 {
+				consider(strips[0], counts[0])
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, errNoRawPreview
+	}
+	return best, nil
+}
+
+// readIFD reads the integer-valued entries of the IFD at offset, along with
+// the offset of the next IFD.
+func readIFD(r io.ReaderAt, order binary.ByteOrder, offset int64) (map[uint16][]int64, int64, error) {
+	countBytes := make([]byte, 2)
+	if _, err := r.ReadAt(countBytes, offset); err != nil {
+		return nil, 0, err
+	}
+	count := int64(order.Uint16(countBytes))
+	entries := make([]byte, count*12+4)
+	if _, err := r.ReadAt(entries, offset+2); err != nil {
+		return nil, 0, err
+	}
+
+	ifd := make(map[uint16][]int64)
+	for i := int64(0); i < count; i++ {
+		entry := entries[i*12 : i*12+12]
+		tag := order.Uint16(entry)
+		valueType := order.Uint16(entry[2:])
+		n := int64(order.Uint32(entry[4:]))
+
+		var size int64
+		switch valueType {
+		case 3: // SHORT
+			size = 2
+		case 4, 13: // LONG, IFD
+			size = 4
+		default:
+			continue
+		}
+		if n <= 0 || n > 1<<16 {
+			continue
+		}
+		data := entry[8:12]
+		if n*size > 4 {
+			data = make([]byte, n*size)
+			if _, err := r.ReadAt(data, int64(order.Uint32(entry[8:]))); err != nil {
+				continue
+			}
+		}
+		values := make([]int64, n)
+		for j := range values {
+			if size == 2 {
+				values[j] = int64(order.Uint16(data[j*2:]))
+			} else {
+				values[j] = int64(order.Uint32(data[j*4:]))
+			}
+		}
+		ifd[tag] = values
+	}
+	return ifd, int64(order.Uint32(entries[count*12:])), nil
+}
+
+// isRawPair reports whether images mix RAW files with other formats, as
+// when a camera saves a RAW file and a JPEG of the same shot.
+func isRawPair(images []ImageInfo) bool {
+	raw, other := false, false
+	for _, img := range images {
+		if isRawFile(img.Path) {
+			raw = true
+		} else {
+			other = true
+		}
+	}
+	return raw && other
+}
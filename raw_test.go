@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildTestRaw lays out a little-endian TIFF container like the RAW formats
+// use: IFD0 points at the first preview with the JPEG offset tags, and each
+// further strip gets a SubIFD of its own, as in CR2 and DNG files.
+func buildTestRaw(first []byte, strips ...[]byte) []byte {
+	type entry struct {
+		tag   uint16
+		typ   uint16
+		count uint32
+		value uint32
+	}
+	ifdSize := func(n int) uint32 { return uint32(2 + 12*n + 4) }
+
+	ifd0Entries := 2
+	if len(strips) > 0 {
+		ifd0Entries++
+	}
+	offset := 8 + ifdSize(ifd0Entries)
+	subOffsets := make([]uint32, len(strips))
+	for i := range strips {
+		subOffsets[i] = offset
+		offset += ifdSize(3)
+	}
+	arrayOffset := offset
+	if len(strips) > 1 {
+		offset += uint32(4 * len(strips))
+	}
+	blobs := append([][]byte{first}, strips...)
+	blobOffsets := make([]uint32, len(blobs))
+	for i, blob := range blobs {
+		blobOffsets[i] = offset
+		offset += uint32(len(blob))
+	}
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	writeIFD := func(entries []entry) {
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&buf, le, e)
+		}
+		binary.Write(&buf, le, uint32(0))
+	}
+
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, le, uint32(8))
+	ifd0 := []entry{
+		{tagJPEGOffset, 4, 1, blobOffsets[0]},
+		{tagJPEGLength, 4, 1, uint32(len(first))},
+	}
+	if len(strips) == 1 {
+		ifd0 = append(ifd0, entry{tagSubIFDs, 4, 1, subOffsets[0]})
+	} else if len(strips) > 1 {
+		ifd0 = append(ifd0, entry{tagSubIFDs, 4, uint32(len(strips)), arrayOffset})
+	}
+	writeIFD(ifd0)
+	for i, strip := range strips {
+		writeIFD([]entry{
+			{tagCompression, 3, 1, tiffCompressionDNG},
+			{tagStripOffsets, 4, 1, blobOffsets[i+1]},
+			{tagStripByteCounts, 4, 1, uint32(len(strip))},
+		})
+	}
+	if len(strips) > 1 {
+		binary.Write(&buf, le, subOffsets)
+	}
+	for _, blob := range blobs {
+		buf.Write(blob)
+	}
+	return buf.Bytes()
+}
+
+func encodeTestJPEG(t *testing.T, w, h, seed int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * seed)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLargestRawPreview(t *testing.T) {
+	thumb := encodeTestJPEG(t, 16, 12, 1)
+	full := encodeTestJPEG(t, 64, 48, 3)
+	medium := encodeTestJPEG(t, 32, 24, 5)
+	// Lossless raw data the standard decoder cannot read must be skipped
+	rawData := []byte{0xff, 0xd8, 0xff, 0xc3, 0, 0, 0, 0}
+
+	data := buildTestRaw(thumb, medium, rawData, full)
+	preview, err := largestRawPreview(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := jpeg.DecodeConfig(preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 64 || config.Height != 48 {
+		t.Errorf("Picked a %dx%d preview, want 64x48", config.Width, config.Height)
+	}
+
+	if _, err := largestRawPreview(bytes.NewReader(buildTestRaw(rawData))); err != errNoRawPreview {
+		t.Errorf("Expected errNoRawPreview, got %v", err)
+	}
+	if _, err := largestRawPreview(bytes.NewReader([]byte("not a tiff file"))); err == nil {
+		t.Error("Expected an error for a non-TIFF file")
+	}
+}
+
+func TestRawImageOpener(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "IMG_0001.CR2")
+	if err := os.WriteFile(raw, buildTestRaw(encodeTestJPEG(t, 40, 30, 7)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "IMG_0001.png")
+	writePNG(t, other, 20, 10, 1)
+
+	opener := RawImageOpener{Next: DefaultImageOpener{}}
+	for path, want := range map[string]image.Point{raw: {40, 30}, other: {20, 10}} {
+		img, err := opener.Open(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got := img.Bounds().Size(); got != want {
+			t.Errorf("%s: size %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRawJPEGPairsAreLabelled(t *testing.T) {
+	corpus := syntheticImageInfos(1, 9)
+	jpg := corpus[0]
+	raw := ImageInfo{Path: "/shoot/IMG_0001.NEF", FileHash: [16]byte{1}, Icon: jpg.Icon}
+	rawCopy := ImageInfo{Path: "/backup/IMG_0001.NEF", FileHash: [16]byte{2}, Icon: jpg.Icon}
+
+	groups := findSimilarImages([]ImageInfo{jpg, raw}, SimilarityOptions{})
+	if len(groups) != 1 || groups[0].Kind != MatchRawPair {
+		t.Fatalf("Expected a RAW/JPEG pair, got %+v", groups)
+	}
+	if actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q"}); len(actions) != 0 {
+		t.Errorf("RAW/JPEG pairs must not be quarantined, got %+v", actions)
+	}
+
+	// Two RAW files alone are ordinary duplicates
+	groups = findSimilarImages([]ImageInfo{raw, rawCopy}, SimilarityOptions{})
+	if len(groups) != 1 || groups[0].Kind != MatchPerceptual {
+		t.Errorf("Expected a perceptual group, got %+v", groups)
+	}
+}
@@ -1,15 +1,72 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
-	"os"
+	"io"
 )
 
 type HTMLData struct {
-	Groups [][]string
+	Groups []DuplicateGroup
 }
 
-func generateHTMLReport(similarGroups [][]string, outputFile string) error {
+// HTMLOptions controls how images are referenced from the report. The zero
+// value links to the original files with file:// URLs.
+type HTMLOptions struct {
+	// EmbedThumbnails inlines downscaled JPEG copies as data URIs so the
+	// report is a single portable file.
+	EmbedThumbnails   bool
+	ThumbnailSize     int // longest side in pixels
+	ThumbnailMaxBytes int
+	Opener            ImageOpener
+	// ImageURL, when set, replaces file:// links, e.g. with URLs served by
+	// the serve command.
+	ImageURL func(path string) template.URL
+}
+
+func (o HTMLOptions) imageSrc(path string) template.URL {
+	if !o.EmbedThumbnails {
+		if o.ImageURL != nil {
+			return o.ImageURL(path)
+		}
+		return fileURL(path)
+	}
+
+	size := o.ThumbnailSize
+	if size <= 0 {
+		size = defaultThumbnailSize
+	}
+	maxBytes := o.ThumbnailMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultThumbnailMaxBytes
+	}
+	var opener ImageOpener = DefaultImageOpener{}
+	if o.Opener != nil {
+		opener = o.Opener
+	}
+
+	src, err := thumbnailDataURI(path, opener, size, maxBytes)
+	if err != nil {
+		fmt.Fprintf(statusOut, "Error creating thumbnail for %s: %v\n", path, err)
+		return fileURL(path)
+	}
+	return src
+}
+
+func generateHTMLReport(similarGroups []DuplicateGroup, outputFile string, opts HTMLOptions) error {
+	file, err := createOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := writeHTMLReport(similarGroups, file, opts); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeHTMLReport(similarGroups []DuplicateGroup, w io.Writer, opts HTMLOptions) error {
 	tmpl := `
 <!DOCTYPE html>
 <html lang="en">
@@ -26,6 +83,8 @@ func generateHTMLReport(similarGroups [][]string, outputFile string) error {
         .image-container { max-width: 200px; }
         img { max-width: 100%; height: auto; border: 1px solid #ddd; }
         .path { font-size: 0.8em; word-break: break-all; margin-top: 5px; }
+        .kind { font-size: 0.9em; color: #999; margin-top: -10px; }
+        .meta, .score { font-size: 0.8em; color: #666; }
     </style>
 </head>
 <body>
@@ -33,11 +92,19 @@ func generateHTMLReport(similarGroups [][]string, outputFile string) error {
     {{range $index, $group := .Groups}}
     <div class="group">
         <h2>Group {{add $index 1}}</h2>
+        <div class="kind">{{kindLabel $group.Kind}}</div>
         <div class="images">
-            {{range $group}}
+            {{range $i, $member := $group.Members}}
             <div class="image-container">
-                <img src="file://{{.}}" alt="Similar Image">
-                <div class="path">{{.}}</div>
+                <img src="{{imageSrc $member.Path}}" alt="Similar Image">
+                <div class="path">{{$member.Path}}</div>
+                <div class="meta">{{if $member.Width}}{{$member.Width}}×{{$member.Height}} · {{end}}{{humanSize $member.Size}}</div>
+                {{if eq $i 0}}<div class="score">Representative</div>{{else}}<div class="score">Distance: {{printf "%.3f" $member.Score}}</div>{{end}}
+                {{if not $member.Region.Empty}}<div class="score">Crop at {{$member.Region.Min.X}},{{$member.Region.Min.Y}} ({{$member.Region.Dx}}×{{$member.Region.Dy}})</div>{{end}}
+                {{if $member.Transform}}<div class="score">{{transformLabel $member.Transform}}</div>{{end}}
+                {{if and (ne $i 0) (ne $member.Kind $group.Kind)}}{{with copyLabel $member.Kind}}<div class="score">{{.}}</div>{{end}}{{end}}
+                {{if and (eq $member.Kind "raw-pair") (ne $group.Kind "raw-pair")}}<div class="score">RAW file, never removed</div>{{end}}
+                {{if $member.Distances}}<div class="score">{{distancesLabel $member.Distances}}</div>{{end}}
             </div>
             {{end}}
         </div>
@@ -48,18 +115,59 @@ func generateHTMLReport(similarGroups [][]string, outputFile string) error {
 `
 
 	t, err := template.New("report").Funcs(template.FuncMap{
-		"add": func(a, b int) int { return a + b },
+		"add":            func(a, b int) int { return a + b },
+		"kindLabel":      kindLabel,
+		"transformLabel": transformLabel,
+		"copyLabel":      copyLabel,
+		"distancesLabel": distancesLabel,
+		"humanSize":      humanSize,
+		"imageSrc":       opts.imageSrc,
 	}).Parse(tmpl)
 	if err != nil {
 		return err
 	}
 
-	file, err := os.Create(outputFile)
-	if err != nil {
-		return err
+	data := HTMLData{Groups: similarGroups}
+	return t.Execute(w, data)
+}
+
+func kindLabel(kind MatchKind) string {
+	switch kind {
+	case MatchIdentical:
+		return "Byte-identical files"
+	case MatchPixelIdentical:
+		return "Pixel-identical images"
+	case MatchPerceptual:
+		return "Visually similar"
+	case MatchRawPair:
+		return "RAW/JPEG pair"
+	case MatchCrop:
+		return "Crops of the first image"
 	}
-	defer file.Close()
+	return string(kind)
+}
 
-	data := HTMLData{Groups: similarGroups}
-	return t.Execute(file, data)
+// copyLabel describes a member that is an exact copy of the representative
+// of a group of weaker matches.
+func copyLabel(kind MatchKind) string {
+	switch kind {
+	case MatchIdentical:
+		return "Same file as the representative"
+	case MatchPixelIdentical:
+		return "Same pixels as the representative"
+	}
+	return ""
+}
+
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
 }
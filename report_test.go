@@ -1,6 +1,7 @@
 package main
 
 import (
+	"image"
 	"os"
 	"strings"
 	"testing"
@@ -104,7 +105,7 @@ func TestGenerateHTMLReport(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := generateHTMLReport(tt.similarGroups, tt.outputFile)
+			err := generateHTMLReport(groupMembers(tt.similarGroups), tt.outputFile, HTMLOptions{})
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("generateHTMLReport() error = %v, wantErr %v", err, tt.wantErr)
@@ -125,3 +126,81 @@ func TestGenerateHTMLReport(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateHTMLReportDetails(t *testing.T) {
+	outputFile := "details_report.html"
+	groups := []DuplicateGroup{
+		{ID: 1, Kind: MatchIdentical, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/path/to/x.jpg", Size: 2048}, Width: 640, Height: 480, Kind: MatchIdentical},
+			{ImageInfo: ImageInfo{Path: "/path/to/y.jpg", Size: 2048}, Width: 640, Height: 480, Kind: MatchIdentical},
+		}},
+		{ID: 2, Kind: MatchPerceptual, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/path/to/a.jpg", Size: 500}, Kind: MatchPerceptual},
+			{ImageInfo: ImageInfo{Path: "/path/to/b.jpg", Size: 3 * 1024 * 1024}, Kind: MatchPerceptual, Score: 0.25},
+			{ImageInfo: ImageInfo{Path: "/path/to/a.dng"}, Kind: MatchRawPair, Score: 0.5},
+			{ImageInfo: ImageInfo{Path: "/path/to/a.png"}, Kind: MatchPixelIdentical},
+		}},
+		{ID: 3, Kind: MatchCrop, Members: []GroupMember{
+			{ImageInfo: ImageInfo{Path: "/path/to/full.jpg"}, Kind: MatchCrop},
+			{ImageInfo: ImageInfo{Path: "/path/to/crop.jpg"}, Kind: MatchCrop, Region: image.Rect(100, 50, 400, 250)},
+		}},
+	}
+
+	if err := generateHTMLReport(groups, outputFile, HTMLOptions{}); err != nil {
+		t.Fatalf("generateHTMLReport() error = %v", err)
+	}
+	defer os.Remove(outputFile)
+
+	content, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated HTML file: %v", err)
+	}
+	expectedStrings := []string{
+		"Byte-identical files",
+		"Visually similar",
+		"640×480 · 2.0 KiB",
+		"500 B",
+		"3.0 MiB",
+		"Representative",
+		"Distance: 0.250",
+		"RAW file, never removed",
+		"Same pixels as the representative",
+		"Crops of the first image",
+		"Crop at 100,50 (300×200)",
+	}
+	for _, str := range expectedStrings {
+		if !strings.Contains(string(content), str) {
+			t.Errorf("Generated HTML does not contain expected string: %s", str)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	testCases := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+	for _, tc := range testCases {
+		if got := humanSize(tc.size); got != tc.expected {
+			t.Errorf("humanSize(%d) = %q, expected %q", tc.size, got, tc.expected)
+		}
+	}
+}
+
+// Helper function to turn plain path groups into perceptual groups
+func groupMembers(groups [][]string) []DuplicateGroup {
+	result := make([]DuplicateGroup, len(groups))
+	for i, group := range groups {
+		result[i] = DuplicateGroup{ID: i + 1, Kind: MatchPerceptual}
+		for _, path := range group {
+			result[i].Members = append(result[i].Members, GroupMember{ImageInfo: ImageInfo{Path: path}, Kind: MatchPerceptual})
+		}
+	}
+	return result
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
 func scanDirectoryRecursive(rootDir string) ([]string, error) {
+	return scanDirectoryFiltered(rootDir, ScanFilter{})
+}
+
+// scanDirectoryFiltered walks rootDir for images, honouring filter and any
+// .dupeignore files along the way. Ignored directories are skipped entirely.
+func scanDirectoryFiltered(rootDir string, filter ScanFilter) ([]string, error) {
 	// First, check if the rootDir is actually a directory
 	fileInfo, err := os.Stat(rootDir)
 	if err != nil {
@@ -16,20 +25,100 @@ func scanDirectoryRecursive(rootDir string) ([]string, error) {
 	if !fileInfo.IsDir() {
 		return nil, fmt.Errorf("the provided path is not a directory: %s", rootDir)
 	}
+	include, err := parseIgnorePatterns(filter.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+	exclude, err := parseIgnorePatterns(filter.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
 
 	var images []string
-	err = filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+	var rules []ignoreRule
+	err = filepath.WalkDir(rootDir, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			ext := filepath.Ext(path)
-			lowerExt := strings.ToLower(ext)
-			if lowerExt == ".jpg" || lowerExt == ".jpeg" || lowerExt == ".png" {
-				images = append(images, path)
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if entry.IsDir() {
+			if rel != "." {
+				if ignored(rules, rel, true) || ignored(exclude, rel, true) {
+					return filepath.SkipDir
+				}
+			} else {
+				rel = ""
 			}
+			// Rules from deeper directories come later, so they win
+			dirRules, err := readDupeignore(path, rel)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, dirRules...)
+			return nil
+		}
+
+		if !(filter.AnyExtension || isImageFile(path, filter.Types)) || ignored(rules, rel, false) || ignored(exclude, rel, false) {
+			return nil
+		}
+		if len(include) > 0 && !included(include, rel) {
+			return nil
+		}
+		if entry.Type().IsRegular() || entry.Type()&fs.ModeSymlink != 0 {
+			images = append(images, path)
 		}
 		return nil
 	})
 	return images, err
 }
+
+// isImageFile reports whether path has the extension of one of types, nil
+// meaning any supported format.
+func isImageFile(path string, types map[string]bool) bool {
+	format := extensionFormat(path)
+	return format != "" && (types == nil || types[format])
+}
+
+// readFileList reads paths separated by NUL bytes, as written by
+// "find -print0" or "git ls-files -z", or by newlines when the list has no
+// NUL. Empty entries are skipped.
+func readFileList(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, path := range strings.Split(string(data), sep) {
+		if sep == "\n" {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// uniquePaths drops repeated paths, such as files found under two
+// overlapping roots, keeping the first occurrence of each.
+func uniquePaths(paths []string) []string {
+	seen := make(map[string]bool, len(paths))
+	var unique []string
+	for _, path := range paths {
+		key := absPath(path)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
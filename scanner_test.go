@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -141,8 +142,13 @@ func TestScanDifferentImageExtensions(t *testing.T) {
 		createNamedTempFile(t, tempDir, "image3.png"),
 		createNamedTempFile(t, tempDir, "image4.PNG"),
 		createNamedTempFile(t, tempDir, "image5.JPG"),
+		createNamedTempFile(t, tempDir, "image6.gif"),
+		createNamedTempFile(t, tempDir, "image7.bmp"),
+		createNamedTempFile(t, tempDir, "image8.tif"),
+		createNamedTempFile(t, tempDir, "image9.TIFF"),
+		createNamedTempFile(t, tempDir, "image10.webp"),
 	}
-	createNamedTempFile(t, tempDir, "image6.gif") // This should not be included
+	createNamedTempFile(t, tempDir, "image11.heic") // This should not be included
 
 	images, err := scanDirectoryRecursive(tempDir)
 	if err != nil {
@@ -154,6 +160,32 @@ func TestScanDifferentImageExtensions(t *testing.T) {
 	}
 }
 
+func TestScanSelectedTypes(t *testing.T) {
+	tempDir := t.TempDir()
+	expectedImages := []string{
+		createNamedTempFile(t, tempDir, "scan.tiff"),
+		createNamedTempFile(t, tempDir, "photo.JPG"),
+	}
+	createNamedTempFile(t, tempDir, "web.webp")
+	createNamedTempFile(t, tempDir, "icon.png")
+
+	types, err := parseImageTypes("tif, jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := scanDirectoryFiltered(tempDir, ScanFilter{Types: types})
+	if err != nil {
+		t.Fatalf("scanDirectoryFiltered failed: %v", err)
+	}
+	if !reflect.DeepEqual(sortStrings(images), sortStrings(expectedImages)) {
+		t.Errorf("Expected images %v, got %v", expectedImages, images)
+	}
+
+	if _, err := parseImageTypes("jpeg,heic"); err == nil {
+		t.Error("Expected an error for an unsupported type")
+	}
+}
+
 func TestScanErrorHandling(t *testing.T) {
 	// Test with a non-existent directory
 	_, err := scanDirectoryRecursive("/path/to/nonexistent/directory")
@@ -189,3 +221,97 @@ func sortStrings(strs []string) []string {
 	sort.Strings(sorted)
 	return sorted
 }
+
+func TestReadFileList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"newlines", "a.jpg\nsub/b c.png\n", []string{"a.jpg", "sub/b c.png"}},
+		{"CRLF and blank lines", "a.jpg\r\n\r\nb.png", []string{"a.jpg", "b.png"}},
+		{"NUL separated", "a.jpg\x00name\nwith newline.png\x00", []string{"a.jpg", "name\nwith newline.png"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readFileList(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniquePaths(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.jpg")
+	b := filepath.Join(dir, "sub", "b.jpg")
+	got := uniquePaths([]string{a, b, filepath.Join(dir, "sub", "..", "a.jpg"), b})
+	if want := []string{a, b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestScanHonoursDupeignoreAndFilters(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{".git", "@eaDir", "2023/previews", "2023/raw", "2024"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{
+		".git/a.jpg", "@eaDir/b.jpg", "2023/previews/c.jpg", "2023/raw/d.png",
+		"2023/e.jpg", "2023/e.tmp.jpg", "2023/keep.tmp.jpg", "2024/f.png", "g.jpg",
+	}
+	for _, file := range files {
+		createNamedTempFile(t, root, file)
+	}
+	writeIgnore := func(dir, content string) {
+		if err := os.WriteFile(filepath.Join(root, dir, dupeignoreName), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeIgnore(".", "# system folders\n.git/\n@eaDir\n*.tmp.jpg\n")
+	writeIgnore("2023", "previews/\n!keep.tmp.jpg\n")
+
+	rel := func(images []string) []string {
+		var names []string
+		for _, image := range images {
+			name, _ := filepath.Rel(root, image)
+			names = append(names, filepath.ToSlash(name))
+		}
+		return sortStrings(names)
+	}
+
+	images, err := scanDirectoryRecursive(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2023/e.jpg", "2023/keep.tmp.jpg", "2023/raw/d.png", "2024/f.png", "g.jpg"}
+	if got := rel(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	images, err = scanDirectoryFiltered(root, ScanFilter{Include: []string{"2023/"}, Exclude: []string{"raw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"2023/e.jpg", "2023/keep.tmp.jpg"}
+	if got := rel(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("Filtered: got %v, want %v", got, want)
+	}
+}
+
+func TestScanRejectsBadDupeignore(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, dupeignoreName), []byte("ok\n[bad\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanDirectoryRecursive(root); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("Expected an error naming line 2, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// reviewHandler serves the HTML report with images loaded over HTTP, since
+// browsers refuse file:// images on pages served from http://.
+type reviewHandler struct {
+	groups []DuplicateGroup
+	// Only files that are part of a group are served
+	paths map[string]bool
+}
+
+func newReviewHandler(groups []DuplicateGroup) http.Handler {
+	h := &reviewHandler{groups: groups, paths: make(map[string]bool)}
+	for _, group := range groups {
+		for _, member := range group.Members {
+			h.paths[member.Path] = true
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.serveReport)
+	mux.HandleFunc("/image", h.serveImage)
+	return mux
+}
+
+func serveReview(addr string, groups []DuplicateGroup) error {
+	return http.ListenAndServe(addr, newReviewHandler(groups))
+}
+
+func (h *reviewHandler) serveReport(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	opts := HTMLOptions{ImageURL: func(path string) template.URL {
+		return template.URL("/image?path=" + url.QueryEscape(path))
+	}}
+	if err := writeHTMLReport(h.groups, w, opts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *reviewHandler) serveImage(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if !h.paths[path] {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
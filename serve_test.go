@@ -0,0 +1,54 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReviewHandler(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeFiles(t, dir, "a.jpg", "b b.jpg", "secret.txt")
+	groups := []DuplicateGroup{{ID: 1, Kind: MatchIdentical, Members: []GroupMember{
+		{ImageInfo: ImageInfo{Path: paths[0]}},
+		{ImageInfo: ImageInfo{Path: paths[1]}},
+	}}}
+	handler := newReviewHandler(groups)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	page := get("/")
+	if page.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the report, got %d", page.Code)
+	}
+	imageURL := "/image?path=" + url.QueryEscape(paths[1])
+	if !strings.Contains(html.UnescapeString(page.Body.String()), `src="`+imageURL+`"`) {
+		t.Errorf("Expected the report to load images from %s", imageURL)
+	}
+
+	if rec := get(imageURL); rec.Code != http.StatusOK || rec.Body.String() != "b b.jpg" {
+		t.Errorf("Expected the grouped image to be served, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/image?path=" + url.QueryEscape(paths[2])); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected files outside the groups to be refused, got %d", rec.Code)
+	}
+	if rec := get("/image?path=" + url.QueryEscape(dir+"/../"+filepath.Base(dir)+"/a.jpg")); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected unlisted spellings of a path to be refused, got %d", rec.Code)
+	}
+	if rec := get("/other"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown pages, got %d", rec.Code)
+	}
+	os.Remove(paths[0])
+	if rec := get("/image?path=" + url.QueryEscape(paths[0])); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed image, got %d", rec.Code)
+	}
+}
@@ -2,31 +2,303 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/vitali-fedulov/images4"
 )
 
-func findSimilarImages(imageInfos []ImageInfo) [][]string {
-	var similarGroups [][]string
+// Threshold presets, as multipliers of the images4.Similar defaults
+var thresholdPresets = map[string]float64{
+	"strict":  0.1,
+	"default": 1.0,
+	"loose":   2.0,
+}
+
+type SimilarityOptions struct {
+	Grouping GroupingMode
+	// Algorithm is the perceptual signature compared; empty means icons.
+	Algorithm HashAlgorithm
+	// Ensemble, if set, replaces Algorithm with a vote of these
+	// algorithms, of which Quorum must agree. Zero means a majority.
+	Ensemble []HashAlgorithm
+	Quorum   int
+	// Threshold scales the images4.Similar limits, or the Hamming distance
+	// limit of a bit hash; 1 reproduces them exactly. Zero means the
+	// default.
+	Threshold float64
+	// MatchTransforms also matches rotated and mirrored copies.
+	MatchTransforms bool
+	// FindCrops also groups crops and padded copies with the image they
+	// come from.
+	FindCrops bool
+	// OnGroup, if set, is called with every group as soon as it is final.
+	OnGroup func(DuplicateGroup)
+}
+
+func (o SimilarityOptions) threshold() float64 {
+	if o.Threshold <= 0 {
+		return thresholdPresets["default"]
+	}
+	return o.Threshold
+}
+
+// hasher returns what compares images, the ensemble if there is one.
+func (o SimilarityOptions) hasher() Hasher {
+	if len(o.Ensemble) > 0 {
+		return newEnsembleHasher(o.Ensemble, o.Quorum)
+	}
+	return hasherFor(o.Algorithm)
+}
+
+func parseThreshold(s string) (float64, error) {
+	if preset, ok := thresholdPresets[strings.ToLower(s)]; ok {
+		return preset, nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid threshold %q (want strict, default, loose or a positive number)", s)
+	}
+	return value, nil
+}
+
+// iconDistance is the largest of the luma, chroma and proportion metrics,
+// each divided by its images4.Similar default. images4.Similar accepts
+// exactly the pairs with a distance below 1.
+func iconDistance(a, b images4.IconT) float64 {
+	m1, m2, m3 := images4.EucMetric(a, b)
+	return math.Max(
+		math.Max(m1/defaultLumaThreshold, images4.PropMetric(a, b)/defaultProportionThreshold),
+		math.Max(m2/defaultChromaThreshold, m3/defaultChromaThreshold),
+	)
+}
+
+// similarWithin is images4.Similar with every limit scaled by threshold.
+func similarWithin(a, b images4.IconT, threshold float64) bool {
+	if !(images4.PropMetric(a, b) < defaultProportionThreshold*threshold) {
+		return false
+	}
+	m1, m2, m3 := images4.EucMetric(a, b)
+	return m1 < defaultLumaThreshold*threshold &&
+		m2 < defaultChromaThreshold*threshold &&
+		m3 < defaultChromaThreshold*threshold
+}
 
+func findSimilarImages(imageInfos []ImageInfo, opts SimilarityOptions) []DuplicateGroup {
 	// Pass 1: File hash comparison
+	var exact []DuplicateGroup
 	fileHashGroups := groupByFileHash(imageInfos)
-	for _, group := range fileHashGroups {
-		if len(group) > 1 {
-			var paths []string
-			for _, img := range group {
-				paths = append(paths, img.Path)
+	for _, img := range imageInfos {
+		group := fileHashGroups[img.FileHash]
+		// Group each hash once, at the position of its first member
+		if len(group) > 1 && group[0].Path == img.Path {
+			exact = append(exact, newDuplicateGroup(MatchIdentical, group))
+		}
+	}
+
+	// Pass 2: Decoded pixels, for copies that only differ in metadata or
+	// encoding. Each later pass sees one representative of every earlier
+	// group, and a group whose representative is matched again joins the
+	// new group.
+	merger := newGroupMerger(exact)
+	candidates := cropCandidates(imageInfos, exact)
+	pixelHashGroups := groupByPixelHash(candidates)
+	var pixelGroups []DuplicateGroup
+	for _, img := range candidates {
+		group := pixelHashGroups[img.PixelHash]
+		if len(group) > 1 && group[0].Path == img.Path {
+			pixelGroups = append(pixelGroups, newDuplicateGroup(MatchPixelIdentical, merger.expand(group)).withExactMembers())
+		}
+	}
+	exact = append(merger.remaining(), pixelGroups...)
+
+	// Pass 3: Image comparison
+	merger = newGroupMerger(exact)
+	candidates = cropCandidates(imageInfos, exact)
+	byPath := make(map[string]ImageInfo, len(candidates))
+	for _, img := range candidates {
+		byPath[img.Path] = img
+	}
+	var perceptualGroups []DuplicateGroup
+	for _, paths := range groupByImageSimilarity(candidates, opts) {
+		images := make([]ImageInfo, len(paths))
+		for i, path := range paths {
+			images[i] = byPath[path]
+		}
+		perceptualGroups = append(perceptualGroups, opts.perceptualGroup(merger.expand(images)).withExactMembers())
+	}
+
+	var groups []DuplicateGroup
+	for _, group := range append(merger.remaining(), perceptualGroups...) {
+		groups = opts.emit(groups, group)
+	}
+
+	// Pass 4: Crops, among images not already a copy of another
+	if opts.FindCrops {
+		for _, group := range findCropGroups(cropCandidates(imageInfos, groups), opts.threshold()) {
+			groups = opts.emit(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// groupMerger lets a pass that only compares the representatives of
+// earlier groups pull in the rest of their members.
+type groupMerger struct {
+	groups   []DuplicateGroup
+	byPath   map[string]int
+	absorbed []bool
+}
+
+func newGroupMerger(groups []DuplicateGroup) *groupMerger {
+	m := &groupMerger{groups: groups, byPath: make(map[string]int), absorbed: make([]bool, len(groups))}
+	for i, group := range groups {
+		m.byPath[group.Members[0].Path] = i
+	}
+	return m
+}
+
+// expand returns images with the other members of an earlier group right
+// after its representative, and marks that group as merged.
+func (m *groupMerger) expand(images []ImageInfo) []ImageInfo {
+	var expanded []ImageInfo
+	for _, img := range images {
+		expanded = append(expanded, img)
+		if i, ok := m.byPath[img.Path]; ok {
+			m.absorbed[i] = true
+			for _, member := range m.groups[i].Members[1:] {
+				expanded = append(expanded, member.ImageInfo)
 			}
-			similarGroups = append(similarGroups, paths)
 		}
 	}
+	return expanded
+}
+
+// remaining returns the earlier groups that were not merged into another.
+func (m *groupMerger) remaining() []DuplicateGroup {
+	var groups []DuplicateGroup
+	for i, group := range m.groups {
+		if !m.absorbed[i] {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// exactMatch reports whether b is a byte-identical or pixel-identical copy
+// of a, and which. RAW files are never pixel-identical, as in
+// groupByPixelHash, and images without a file hash are never exact.
+func exactMatch(a, b ImageInfo) (MatchKind, bool) {
+	if a.FileHash == ([16]byte{}) {
+		return "", false
+	}
+	if a.FileHash == b.FileHash {
+		return MatchIdentical, true
+	}
+	if a.PixelHash == b.PixelHash && a.PixelHash != ([16]byte{}) && !isRawFile(a.Path) && !isRawFile(b.Path) {
+		return MatchPixelIdentical, true
+	}
+	return "", false
+}
+
+// withExactMembers marks the members that are exact copies of the
+// representative as such, with a distance of 0, in a group merged from
+// groups of different kinds. The RAW files of a RAW/JPEG pair keep their
+// kind.
+func (g DuplicateGroup) withExactMembers() DuplicateGroup {
+	for i := 1; i < len(g.Members); i++ {
+		if g.Members[i].Kind == MatchRawPair {
+			continue
+		}
+		if kind, ok := exactMatch(g.Members[0].ImageInfo, g.Members[i].ImageInfo); ok {
+			member := &g.Members[i]
+			member.Kind, member.Score = kind, 0
+			member.Transform, member.Distances = TransformNone, nil
+		}
+	}
+	return g
+}
+
+// perceptualKind labels a group of visually similar images. A group mixing
+// RAW files with other formats is a RAW/JPEG pair, unless it also holds
+// duplicates among the other formats, or byte-identical copies of a RAW
+// file.
+func perceptualKind(images []ImageInfo) MatchKind {
+	if !isRawPair(images) {
+		return MatchPerceptual
+	}
+	others := 0
+	for i, img := range images {
+		if !isRawFile(img.Path) || isCopy(images[:i], img) {
+			others++
+		}
+	}
+	if others > 1 {
+		return MatchPerceptual
+	}
+	return MatchRawPair
+}
+
+// isCopy reports whether img is a byte-identical copy of one of images.
+func isCopy(images []ImageInfo, img ImageInfo) bool {
+	for _, other := range images {
+		if kind, ok := exactMatch(other, img); ok && kind == MatchIdentical {
+			return true
+		}
+	}
+	return false
+}
 
-	// Pass 2: Image comparison
-	remainingImages := getRemainingImages(imageInfos, similarGroups)
-	imgGroups := groupByImageSimilarity(remainingImages)
-	similarGroups = append(similarGroups, imgGroups...)
+// distance scores b against a the way perceptual groups are scored; below
+// the threshold, the two images match.
+func (o SimilarityOptions) distance(a, b ImageInfo) float64 {
+	if o.MatchTransforms {
+		_, d := closestTransform(a.Icon, b.Icon)
+		return d
+	}
+	return o.hasher().Distance(a, b)
+}
+
+// perceptualGroup builds a group of visually similar images, scored with
+// the selected algorithm. With MatchTransforms, members are scored against
+// the rotation or mirroring of the representative they are closest to; with
+// an ensemble, members also keep the distance of every algorithm. When RAW
+// files sit among duplicates in other formats, only they are marked as
+// RAW/JPEG pairs.
+func (o SimilarityOptions) perceptualGroup(images []ImageInfo) DuplicateGroup {
+	group := newDuplicateGroup(perceptualKind(images), images)
+	if isRawPair(images) {
+		for i := range group.Members {
+			if isRawFile(group.Members[i].Path) {
+				group.Members[i].Kind = MatchRawPair
+			}
+		}
+	}
+	hasher := o.hasher()
+	for i := 1; i < len(group.Members); i++ {
+		member := &group.Members[i]
+		if o.MatchTransforms {
+			member.Transform, member.Score = closestTransform(images[0].Icon, member.Icon)
+		} else {
+			member.Score = o.distance(images[0], member.ImageInfo)
+		}
+		if ensemble, ok := hasher.(ensembleHasher); ok {
+			member.Distances = ensemble.distances(images[0], member.ImageInfo)
+		}
+	}
+	return group
+}
 
-	return similarGroups
+// emit numbers a finished group, reports it and appends it to groups.
+func (o SimilarityOptions) emit(groups []DuplicateGroup, group DuplicateGroup) []DuplicateGroup {
+	group.ID = len(groups) + 1
+	if o.OnGroup != nil {
+		o.OnGroup(group)
+	}
+	return append(groups, group)
 }
 
 func groupByFileHash(imageInfos []ImageInfo) map[[16]byte][]ImageInfo {
@@ -37,58 +309,227 @@ func groupByFileHash(imageInfos []ImageInfo) map[[16]byte][]ImageInfo {
 	return groups
 }
 
-func groupByImageSimilarity(imageInfos []ImageInfo) [][]string {
+// groupByPixelHash groups images by their decoded pixels. RAW files are
+// left out: their embedded preview may be the very JPEG saved beside them,
+// and that pair is worth keeping.
+func groupByPixelHash(imageInfos []ImageInfo) map[[16]byte][]ImageInfo {
+	groups := make(map[[16]byte][]ImageInfo)
+	for _, img := range imageInfos {
+		if img.PixelHash == ([16]byte{}) || isRawFile(img.Path) {
+			continue
+		}
+		groups[img.PixelHash] = append(groups[img.PixelHash], img)
+	}
+	return groups
+}
+
+func groupByImageSimilarity(imageInfos []ImageInfo, opts SimilarityOptions) [][]string {
+	index := newSimilarityIndex(imageInfos, opts)
+
+	switch opts.Grouping {
+	case GroupingTransitive:
+		return clusterTransitive(imageInfos, findSimilarPairs(index))
+	case GroupingClique:
+		return clusterClique(imageInfos, findSimilarPairs(index))
+	default:
+		return groupByAnchor(index)
+	}
+}
+
+// similarityIndex finds the images similar to each image. Icons go through
+// a neighborIndex; with transforms, the rotated and mirrored variants of
+// every icon are indexed alongside the originals, so a copy matches
+// whichever variant it resembles. Bit hashes go through a hammingIndex.
+// An ensemble takes its candidates from enough of its algorithms that
+// every pair a quorum agrees on is among them, and checks each candidate
+// with all of its algorithms.
+type similarityIndex struct {
+	images    []ImageInfo
+	variants  []ImageInfo // images, followed by each transform of them
+	index     *neighborIndex
+	sources   []candidateIndex
+	hasher    Hasher
+	threshold float64
+}
+
+// candidateIndex returns, in ascending order, the indices of the images
+// that may be similar to image i, never i itself.
+type candidateIndex interface {
+	Candidates(i int) []int
+}
+
+func newSimilarityIndex(images []ImageInfo, opts SimilarityOptions) *similarityIndex {
+	threshold := opts.threshold()
+	s := &similarityIndex{images: images, variants: images, hasher: opts.hasher(), threshold: threshold}
+	switch hasher := s.hasher.(type) {
+	case ensembleHasher:
+		// A pair a quorum agrees on passes all but at most
+		// len(hashers)-quorum algorithms, so it is found by any one more
+		// than that. Bit hashes come first, as they are cheaper to index.
+		hashers := append([]Hasher(nil), hasher.hashers...)
+		sort.SliceStable(hashers, func(a, b int) bool {
+			return hashers[a].Algorithm() != AlgoIcon && hashers[b].Algorithm() == AlgoIcon
+		})
+		for _, h := range hashers[:len(hashers)-hasher.quorum+1] {
+			s.sources = append(s.sources, newCandidateIndex(images, h, threshold))
+		}
+		return s
+	case bitHasher:
+		s.sources = []candidateIndex{newCandidateIndex(images, hasher, threshold)}
+		return s
+	}
+	if opts.MatchTransforms {
+		s.variants = make([]ImageInfo, 0, len(images)*(len(iconTransforms)+1))
+		s.variants = append(s.variants, images...)
+		for _, t := range iconTransforms {
+			for _, img := range images {
+				img.Icon = transformIcon(img.Icon, t.orientation)
+				s.variants = append(s.variants, img)
+			}
+		}
+	}
+	s.index = newNeighborIndex(s.variants, defaultLumaThreshold*threshold, defaultProportionThreshold*threshold)
+	return s
+}
+
+// newCandidateIndex indexes images by the signature of one algorithm. A bit
+// hash matches below limit*threshold differing bits, so no match is further
+// than the floor of that.
+func newCandidateIndex(images []ImageInfo, h Hasher, threshold float64) candidateIndex {
+	if bh, ok := h.(bitHasher); ok {
+		return newHammingIndex(images, bh.algorithm, int(float64(bh.limit)*threshold))
+	}
+	return newNeighborIndex(images, defaultLumaThreshold*threshold, defaultProportionThreshold*threshold)
+}
+
+// similar returns the indices j, lo <= j < hi, of the images similar to
+// images[i], in ascending order.
+func (s *similarityIndex) similar(i, lo, hi int) []int {
+	var similar []int
+	if s.index == nil {
+		for _, j := range s.candidates(i) {
+			if j >= lo && j < hi && s.hasher.Distance(s.images[i], s.images[j]) < s.threshold {
+				similar = append(similar, j)
+			}
+		}
+		return similar
+	}
+	for _, k := range s.index.Candidates(i) {
+		j := k % len(s.images)
+		if j != i && j >= lo && j < hi && similarWithin(s.images[i].Icon, s.variants[k].Icon, s.threshold) {
+			similar = append(similar, j)
+		}
+	}
+	if len(s.variants) > len(s.images) {
+		similar = uniqueInts(similar)
+	}
+	return similar
+}
+
+// candidates merges the candidates of every source.
+func (s *similarityIndex) candidates(i int) []int {
+	if len(s.sources) == 1 {
+		return s.sources[0].Candidates(i)
+	}
+	var candidates []int
+	for _, source := range s.sources {
+		candidates = append(candidates, source.Candidates(i)...)
+	}
+	return uniqueInts(candidates)
+}
+
+// uniqueInts sorts values and drops repeats, in place. An image may match
+// several variants of another, or be found by several sources.
+func uniqueInts(values []int) []int {
+	sort.Ints(values)
+	unique := values[:0]
+	for n, v := range values {
+		if n == 0 || v != values[n-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+// distance scores images[j] against images[i] as the groups they form are
+// scored.
+func (s *similarityIndex) distance(i, j int) float64 {
+	if len(s.variants) > len(s.images) {
+		_, d := closestTransform(s.images[i].Icon, s.images[j].Icon)
+		return d
+	}
+	return s.hasher.Distance(s.images[i], s.images[j])
+}
+
+// findSimilarPairs returns every pair (i, j) with i < j whose icons are
+// similar within the index threshold.
+func findSimilarPairs(index *similarityIndex) [][2]int {
+	var pairs [][2]int
+	imageInfos := index.images
+	for i := range imageInfos {
+		for _, j := range index.similar(i, i+1, len(imageInfos)) {
+			pairs = append(pairs, [2]int{i, j})
+		}
+
+		if (i+1)%100 == 0 || i+1 == len(imageInfos) {
+			fmt.Fprintf(statusOut, "\rImage comparison progress: %d/%d", i+1, len(imageInfos))
+		}
+	}
+
+	fmt.Fprintln(statusOut) // New line after progress
+	return pairs
+}
+
+func groupByAnchor(index *similarityIndex) [][]string {
 	var groups [][]string
+	imageInfos := index.images
 	compared := make(map[string]bool)
-	totalComparisons := (len(imageInfos) * (len(imageInfos) - 1)) / 2
-	comparisonsDone := 0
 
 	for i, img1 := range imageInfos {
 		if compared[img1.Path] {
 			continue
 		}
 
+		// Only images the index cannot rule out get the full comparison
 		group := []string{img1.Path}
-		for j := i + 1; j < len(imageInfos); j++ {
+		for _, j := range index.similar(i, i+1, len(imageInfos)) {
 			img2 := imageInfos[j]
 			if compared[img2.Path] {
 				continue
 			}
-
-			if images4.Similar(img1.Icon, img2.Icon) {
-				group = append(group, img2.Path)
-				compared[img2.Path] = true
-			}
-
-			comparisonsDone++
-			if comparisonsDone%10 == 0 || comparisonsDone == totalComparisons {
-				fmt.Printf("\rImage comparison progress: %d/%d", comparisonsDone, totalComparisons)
-			}
+			group = append(group, img2.Path)
+			compared[img2.Path] = true
 		}
 
 		if len(group) > 1 {
 			groups = append(groups, group)
 		}
 		compared[img1.Path] = true
+
+		if (i+1)%100 == 0 || i+1 == len(imageInfos) {
+			fmt.Fprintf(statusOut, "\rImage comparison progress: %d/%d", i+1, len(imageInfos))
+		}
 	}
 
-	fmt.Println() // New line after progress
+	fmt.Fprintln(statusOut) // New line after progress
 	return groups
 }
 
-func getRemainingImages(allImages []ImageInfo, groupedImages [][]string) []ImageInfo {
-	grouped := make(map[string]bool)
-	for _, group := range groupedImages {
-		for _, path := range group {
-			grouped[path] = true
+// cropCandidates returns the images that are not a duplicate of another:
+// the representative of every group and the ungrouped images.
+func cropCandidates(allImages []ImageInfo, groups []DuplicateGroup) []ImageInfo {
+	duplicate := make(map[string]bool)
+	for _, group := range groups {
+		for _, member := range group.Members[1:] {
+			duplicate[member.Path] = true
 		}
 	}
 
-	var remaining []ImageInfo
+	var candidates []ImageInfo
 	for _, img := range allImages {
-		if !grouped[img.Path] {
-			remaining = append(remaining, img)
+		if !duplicate[img.Path] {
+			candidates = append(candidates, img)
 		}
 	}
-	return remaining
+	return candidates
 }
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// Helper function to build a deterministic corpus of icons. Every base image
+// gets a few variants (brightness shifts, noise, rescales and re-crops) so the
+// corpus contains both near-duplicates and unrelated images.
+func syntheticImageInfos(n int, seed int64) []ImageInfo {
+	rng := rand.New(rand.NewSource(seed))
+	sizes := []image.Point{{64, 48}, {48, 64}, {60, 60}, {80, 45}}
+
+	var infos []ImageInfo
+	for len(infos) < n {
+		size := sizes[rng.Intn(len(sizes))]
+		base := randomBlobImage(rng, size)
+		infos = append(infos, syntheticImageInfo(len(infos), base))
+
+		for v := rng.Intn(4); v > 0 && len(infos) < n; v-- {
+			variant := varyImage(rng, base)
+			infos = append(infos, syntheticImageInfo(len(infos), variant))
+		}
+	}
+
+	// Shuffle so variants are not adjacent to their base
+	rng.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
+	return infos
+}
+
+func syntheticImageInfo(n int, img image.Image) ImageInfo {
+	path := fmt.Sprintf("/corpus/%05d.jpg", n)
+	info := ImageInfo{Path: path, FileHash: md5.Sum([]byte(path)), Icon: images4.Icon(img)}
+	for _, h := range bitHashers {
+		h.Hash(img, &info)
+	}
+	return info
+}
+
+func randomBlobImage(rng *rand.Rand, size image.Point) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	bg := color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			img.SetRGBA(x, y, bg)
+		}
+	}
+	for b := 0; b < 3+rng.Intn(4); b++ {
+		c := color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+		x0, y0 := rng.Intn(size.X), rng.Intn(size.Y)
+		w, h := 5+rng.Intn(size.X/2), 5+rng.Intn(size.Y/2)
+		for y := y0; y < y0+h && y < size.Y; y++ {
+			for x := x0; x < x0+w && x < size.X; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func varyImage(rng *rand.Rand, src *image.RGBA) image.Image {
+	bounds := src.Bounds()
+	switch rng.Intn(4) {
+	case 0: // Brightness shift
+		shift := rng.Intn(30) - 15
+		out := image.NewRGBA(bounds)
+		for i, v := range src.Pix {
+			if i%4 == 3 {
+				out.Pix[i] = v
+				continue
+			}
+			out.Pix[i] = uint8(clampInt(int(v)+shift, 0, 255))
+		}
+		return out
+	case 1: // Noise
+		out := image.NewRGBA(bounds)
+		for i, v := range src.Pix {
+			if i%4 == 3 {
+				out.Pix[i] = v
+				continue
+			}
+			out.Pix[i] = uint8(clampInt(int(v)+rng.Intn(21)-10, 0, 255))
+		}
+		return out
+	case 2: // Upscale with the same aspect ratio
+		w, h := bounds.Dx()*2, bounds.Dy()*2
+		out := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				out.Set(x, y, src.At(x/2, y/2))
+			}
+		}
+		return out
+	default: // Slight crop
+		return src.SubImage(image.Rect(1, 1, bounds.Dx()-1, bounds.Dy()-1))
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// Reference implementation: the original quadratic anchor grouping
+func bruteForceImageSimilarity(imageInfos []ImageInfo) [][]string {
+	return bruteForceGroups(imageInfos, func(a, b ImageInfo) bool {
+		return images4.Similar(a.Icon, b.Icon)
+	})
+}
+
+// bruteForceGroups is anchor grouping comparing every pair of images.
+func bruteForceGroups(imageInfos []ImageInfo, similar func(a, b ImageInfo) bool) [][]string {
+	var groups [][]string
+	compared := make(map[string]bool)
+	for i, img1 := range imageInfos {
+		if compared[img1.Path] {
+			continue
+		}
+		group := []string{img1.Path}
+		for j := i + 1; j < len(imageInfos); j++ {
+			img2 := imageInfos[j]
+			if compared[img2.Path] {
+				continue
+			}
+			if similar(img1, img2) {
+				group = append(group, img2.Path)
+				compared[img2.Path] = true
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		compared[img1.Path] = true
+	}
+	return groups
+}
+
+func TestGroupByImageSimilarityMatchesBruteForce(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3} {
+		t.Run(fmt.Sprintf("Seed%d", seed), func(t *testing.T) {
+			infos := syntheticImageInfos(250, seed)
+
+			want := bruteForceImageSimilarity(infos)
+			got := groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingAnchor})
+
+			if len(want) == 0 {
+				t.Fatalf("Corpus produced no similar groups; the test would prove nothing")
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Indexed grouping differs from brute force:\nwant %v\ngot  %v", want, got)
+			}
+		})
+	}
+}
+
+func TestNeighborIndexCandidatesAreComplete(t *testing.T) {
+	infos := syntheticImageInfos(200, 42)
+	index := newNeighborIndex(infos, defaultLumaThreshold, defaultProportionThreshold)
+
+	for i := range infos {
+		candidates := make(map[int]bool)
+		for _, j := range index.Candidates(i) {
+			if j == i {
+				t.Fatalf("Candidates(%d) includes the image itself", i)
+			}
+			candidates[j] = true
+		}
+		for j := range infos {
+			if j != i && images4.Similar(infos[i].Icon, infos[j].Icon) && !candidates[j] {
+				t.Errorf("Similar pair (%d, %d) missing from candidates", i, j)
+			}
+		}
+	}
+}
+
+func TestNeighborIndexSkipsInvalidIcons(t *testing.T) {
+	infos := []ImageInfo{
+		{Path: "empty.jpg"},
+		{Path: "mock.jpg", Icon: images4.IconT{Pixels: []uint16{1, 2, 3}}},
+	}
+	index := newNeighborIndex(infos, defaultLumaThreshold, defaultProportionThreshold)
+	for i := range infos {
+		if got := index.Candidates(i); len(got) != 0 {
+			t.Errorf("Expected no candidates for invalid icon %d, got %v", i, got)
+		}
+	}
+}
+
+func TestFindSimilarImages(t *testing.T) {
+	infos := syntheticImageInfos(60, 7)
+	// Two byte-identical copies that look like infos[0]
+	infos = append(infos,
+		ImageInfo{Path: "/copy/a.jpg", FileHash: [16]byte{9}, Icon: infos[0].Icon},
+		ImageInfo{Path: "/copy/b.jpg", FileHash: [16]byte{9}, Icon: infos[0].Icon},
+	)
+
+	groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive})
+
+	seen := make(map[string]bool)
+	var copies []string
+	for i, group := range groups {
+		if group.ID != i+1 {
+			t.Errorf("Expected group %d to have ID %d, got %d", i, i+1, group.ID)
+		}
+		if len(group.Members) < 2 {
+			t.Errorf("Group with fewer than two images: %v", group.Paths())
+		}
+		if group.Kind != MatchPerceptual {
+			t.Errorf("Expected group %v to be marked %s, got %s", group.Paths(), MatchPerceptual, group.Kind)
+		}
+		for _, member := range group.Members {
+			if seen[member.Path] {
+				t.Errorf("Path %s appears in more than one group", member.Path)
+			}
+			seen[member.Path] = true
+			if member.Kind != group.Kind && !(isExactKind(member.Kind) && member.Score == 0) {
+				t.Errorf("Member %s has kind %s in a %s group", member.Path, member.Kind, group.Kind)
+			}
+			if member.Width == 0 || member.Height == 0 {
+				t.Errorf("Member %s is missing its dimensions", member.Path)
+			}
+			if member.Path == "/copy/a.jpg" {
+				copies = group.Paths()
+			}
+		}
+	}
+	// The copies join the image they look like, side by side
+	want := map[string]bool{"/copy/a.jpg": true, "/copy/b.jpg": true, infos[0].Path: true}
+	found := 0
+	for i, path := range copies {
+		if want[path] {
+			found++
+		}
+		if path == "/copy/a.jpg" && (i+1 == len(copies) || copies[i+1] != "/copy/b.jpg") {
+			t.Errorf("Expected /copy/b.jpg right after /copy/a.jpg, got %v", copies)
+		}
+	}
+	if found != len(want) {
+		t.Errorf("Expected the byte-identical copies to be grouped with %s, got %v", infos[0].Path, copies)
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	testCases := []struct {
+		input     string
+		expected  float64
+		expectErr bool
+	}{
+		{"strict", 0.1, false},
+		{"default", 1, false},
+		{"LOOSE", 2, false},
+		{"1.5", 1.5, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"fuzzy", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := parseThreshold(tc.input)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("parseThreshold(%q) error = %v, expectErr %v", tc.input, err, tc.expectErr)
+			}
+			if got != tc.expected {
+				t.Errorf("parseThreshold(%q) = %v, expected %v", tc.input, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestIconDistanceAgreesWithSimilar(t *testing.T) {
+	infos := syntheticImageInfos(120, 21)
+	for i := range infos {
+		if d := iconDistance(infos[i].Icon, infos[i].Icon); d != 0 {
+			t.Fatalf("Expected distance 0 from an icon to itself, got %v", d)
+		}
+		for j := i + 1; j < len(infos); j++ {
+			a, b := infos[i].Icon, infos[j].Icon
+			similar := images4.Similar(a, b)
+			if similarWithin(a, b, 1) != similar {
+				t.Errorf("similarWithin(%d, %d, 1) disagrees with images4.Similar", i, j)
+			}
+			if (iconDistance(a, b) < 1) != similar {
+				t.Errorf("iconDistance(%d, %d) = %v disagrees with images4.Similar = %v", i, j, iconDistance(a, b), similar)
+			}
+		}
+	}
+}
+
+func TestThresholdChangesGrouping(t *testing.T) {
+	chain := chainImageInfos()
+
+	testCases := []struct {
+		name      string
+		threshold float64
+		expected  [][]string
+	}{
+		{"Strict", thresholdPresets["strict"], nil},
+		{"Default", thresholdPresets["default"], [][]string{{"/a.jpg", "/b.jpg"}}},
+		{"Loose", thresholdPresets["loose"], [][]string{{"/a.jpg", "/b.jpg", "/c.jpg"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := groupByImageSimilarity(chain, SimilarityOptions{Grouping: GroupingClique, Threshold: tc.threshold})
+			if !reflect.DeepEqual(groups, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, groups)
+			}
+		})
+	}
+}
+
+func TestFindSimilarImagesScores(t *testing.T) {
+	groups := findSimilarImages(chainImageInfos(), SimilarityOptions{Grouping: GroupingTransitive})
+	if len(groups) != 1 || len(groups[0].Members) != 3 {
+		t.Fatalf("Expected one group of three, got %v", groups)
+	}
+
+	members := groups[0].Members
+	if members[0].Score != 0 {
+		t.Errorf("Expected the representative to score 0, got %v", members[0].Score)
+	}
+	if members[1].Score <= 0 || members[1].Score >= 1 {
+		t.Errorf("Expected a direct match to score in (0, 1), got %v", members[1].Score)
+	}
+	if members[2].Score <= members[1].Score {
+		t.Errorf("Expected the end of the chain (%v) to score further than its neighbour (%v)", members[2].Score, members[1].Score)
+	}
+}
+
+func TestFindSimilarImagesPixelIdentical(t *testing.T) {
+	icon := syntheticImageInfos(1, 13)[0].Icon
+	pixels := [16]byte{7}
+	info := func(path string) ImageInfo {
+		return ImageInfo{Path: path, FileHash: md5.Sum([]byte(path)), PixelHash: pixels, Icon: icon}
+	}
+	// The same pixels with different metadata, and a RAW file whose
+	// preview they are
+	infos := []ImageInfo{info("/a.png"), info("/a-tagged.png"), info("/raw/a.dng")}
+
+	groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive})
+	if len(groups) != 1 || !reflect.DeepEqual(groups[0].Paths(), []string{"/a.png", "/a-tagged.png", "/raw/a.dng"}) {
+		t.Fatalf("Expected the PNGs grouped with the RAW file, got %v", groups)
+	}
+	if member := groups[0].Members[1]; member.Score != 0 || member.Kind != MatchPixelIdentical {
+		t.Errorf("%s: expected a pixel-identical member scoring 0, got %s %v", member.Path, member.Kind, member.Score)
+	}
+	if kind := groups[0].Members[2].Kind; kind != MatchRawPair {
+		t.Errorf("Expected the RAW file to be left out of the pixel-identical pass, got %s", kind)
+	}
+
+	kinds, err := parseMatchKinds("identical,pixel-identical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q", Kinds: kinds})
+	if len(actions) != 1 || actions[0].Source != "/a-tagged.png" {
+		t.Errorf("Expected the pixel-identical copy to be quarantined, got %v", actions)
+	}
+}
+
+// Every image of an earlier pass takes part in the later ones through the
+// representative of its group
+func TestFindSimilarImagesMergesPasses(t *testing.T) {
+	icon := syntheticImageInfos(1, 13)[0].Icon
+	info := func(path string, file, pixels byte) ImageInfo {
+		return ImageInfo{Path: path, FileHash: [16]byte{file}, PixelHash: [16]byte{pixels}, Icon: icon}
+	}
+
+	testCases := []struct {
+		name      string
+		infos     []ImageInfo
+		kind      MatchKind
+		kinds     []MatchKind
+		moved     int
+		movedSafe int
+	}{
+		{
+			name:      "ByteTwinAndMetadataCopy",
+			infos:     []ImageInfo{info("/a.jpg", 1, 1), info("/a-copy.jpg", 1, 1), info("/a-pixels.png", 2, 1)},
+			kind:      MatchPixelIdentical,
+			kinds:     []MatchKind{MatchPixelIdentical, MatchIdentical, MatchPixelIdentical},
+			moved:     2,
+			movedSafe: 2,
+		},
+		{
+			name:      "PixelTwinAndReencode",
+			infos:     []ImageInfo{info("/a.jpg", 1, 1), info("/a-pixels.png", 2, 1), info("/reencoded/a-q60.jpg", 3, 3)},
+			kind:      MatchPerceptual,
+			kinds:     []MatchKind{MatchPerceptual, MatchPixelIdentical, MatchPerceptual},
+			moved:     2,
+			movedSafe: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := findSimilarImages(tc.infos, SimilarityOptions{Grouping: GroupingTransitive})
+			if len(groups) != 1 || len(groups[0].Members) != len(tc.infos) {
+				t.Fatalf("Expected every image in one group, got %v", groups)
+			}
+			group := groups[0]
+			var kinds []MatchKind
+			for _, member := range group.Members {
+				kinds = append(kinds, member.Kind)
+			}
+			if group.Kind != tc.kind || !reflect.DeepEqual(kinds, tc.kinds) {
+				t.Errorf("Expected a %s group with members %v, got a %s group with %v", tc.kind, tc.kinds, group.Kind, kinds)
+			}
+
+			if actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q"}); len(actions) != tc.moved {
+				t.Errorf("Expected %d images moved, got %+v", tc.moved, actions)
+			}
+			exact := map[MatchKind]bool{MatchIdentical: true, MatchPixelIdentical: true}
+			if actions := planQuarantine(groups, ApplyOptions{Policy: defaultKeepPolicy, QuarantineDir: "/q", Kinds: exact}); len(actions) != tc.movedSafe {
+				t.Errorf("Expected %d exact copies moved, got %+v", tc.movedSafe, actions)
+			}
+		})
+	}
+}
+
+func benchmarkCorpus(b *testing.B) []ImageInfo {
+	b.Helper()
+	return syntheticImageInfos(3000, 99)
+}
+
+func BenchmarkGroupByImageSimilarityIndexed(b *testing.B) {
+	infos := benchmarkCorpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingAnchor})
+	}
+}
+
+func BenchmarkGroupByImageSimilarityDHashIndexed(b *testing.B) {
+	infos := benchmarkCorpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingAnchor, Algorithm: AlgoDifference})
+	}
+}
+
+func BenchmarkGroupByImageSimilarityDHashBruteForce(b *testing.B) {
+	infos := benchmarkCorpus(b)
+	hasher := hasherFor(AlgoDifference)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForceGroups(infos, func(a, b ImageInfo) bool { return hasher.Distance(a, b) < 1 })
+	}
+}
+
+func BenchmarkGroupByImageSimilarityBruteForce(b *testing.B) {
+	infos := benchmarkCorpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForceImageSimilarity(infos)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// TypeMismatch is a file whose extension does not match its content.
+// Detected is empty when the content is not a decodable image.
+type TypeMismatch struct {
+	Path      string
+	Extension string
+	Detected  string
+}
+
+// sniffFormat detects the image format of a file from its first bytes,
+// returning "" if it is not a decodable image.
+func sniffFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "tiff", nil
+	}
+	return contentFormats[http.DetectContentType(head)], nil
+}
+
+// sniffImages keeps the files whose content is an image of one of types
+// (nil meaning any), whatever their extension, and lists every file whose
+// extension says otherwise. Unreadable files are reported and skipped.
+func sniffImages(paths []string, types map[string]bool) ([]string, []TypeMismatch) {
+	var images []string
+	var mismatches []TypeMismatch
+	for _, path := range paths {
+		detected, err := sniffFormat(path)
+		if err != nil {
+			fmt.Fprintf(statusOut, "Error reading %s: %v\n", path, err)
+			continue
+		}
+		if detected == "tiff" && isRawFile(path) {
+			// RAW files are TIFF containers
+			detected = rawFormat
+		}
+		if detected != extensionFormat(path) {
+			mismatches = append(mismatches, TypeMismatch{Path: path, Extension: filepath.Ext(path), Detected: detected})
+		}
+		if detected != "" && (types == nil || types[detected]) {
+			images = append(images, path)
+		}
+	}
+	return images, mismatches
+}
+
+// describe says what is wrong with the file, for status output.
+func (m TypeMismatch) describe() string {
+	ext := m.Extension
+	if ext == "" {
+		ext = "no extension"
+	}
+	if m.Detected == "" {
+		return ext + ", but not an image"
+	}
+	return ext + ", but " + m.Detected + " content"
+}
+
+// writeMismatchReport writes the mismatches as CSV.
+func writeMismatchReport(mismatches []TypeMismatch, outputFile string) error {
+	file, err := createOutput(outputFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"path", "extension", "detected"})
+	for _, m := range mismatches {
+		writer.Write([]string{m.Path, m.Extension, m.Detected})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSniffImages(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "photo.png"), 32, 24, 1)
+	writePNG(t, filepath.Join(dir, "IMG_001"), 32, 24, 3)
+	writePNG(t, filepath.Join(dir, "wrong.jpg"), 32, 24, 5)
+
+	file, err := os.Create(filepath.Join(dir, "scan.JPG_original"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(file, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if err := os.WriteFile(filepath.Join(dir, "notes.jpg"), []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := scanDirectoryFiltered(dir, ScanFilter{AnyExtension: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, mismatches := sniffImages(paths, nil)
+
+	var names []string
+	for _, path := range images {
+		names = append(names, filepath.Base(path))
+	}
+	if want := []string{"IMG_001", "photo.png", "scan.JPG_original", "wrong.jpg"}; !reflect.DeepEqual(sortStrings(names), want) {
+		t.Errorf("Images = %v, want %v", names, want)
+	}
+
+	got := make(map[string]TypeMismatch)
+	for _, m := range mismatches {
+		got[filepath.Base(m.Path)] = m
+	}
+	want := map[string]TypeMismatch{
+		"IMG_001":           {Extension: "", Detected: "png"},
+		"scan.JPG_original": {Extension: ".JPG_original", Detected: "jpeg"},
+		"wrong.jpg":         {Extension: ".jpg", Detected: "png"},
+		"notes.jpg":         {Extension: ".jpg", Detected: ""},
+	}
+	if len(got) != len(want) {
+		t.Errorf("Got mismatches %+v", mismatches)
+	}
+	for name, w := range want {
+		m, ok := got[name]
+		if !ok || m.Extension != w.Extension || m.Detected != w.Detected {
+			t.Errorf("%s: got %+v, want %+v", name, m, w)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultThumbnailSize     = 240
+	defaultThumbnailMaxBytes = 48 * 1024
+	minThumbnailSize         = 16
+)
+
+// Lower JPEG quality is tried before shrinking the thumbnail further
+var thumbnailQualities = []int{85, 70, 55, 40}
+
+// makeThumbnail scales img down so its longest side is at most maxSide.
+// Smaller images are returned unchanged.
+func makeThumbnail(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+
+	if w >= h {
+		h = max(1, h*maxSide/w)
+		w = maxSide
+	} else {
+		w = max(1, w*maxSide/h)
+		h = maxSide
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Src, nil)
+	return thumb
+}
+
+// encodeThumbnail returns JPEG bytes no larger than maxBytes, lowering the
+// quality first and then halving the dimensions until it fits.
+func encodeThumbnail(img image.Image, maxSide, maxBytes int) ([]byte, error) {
+	var buf bytes.Buffer
+	for side := maxSide; side >= minThumbnailSize; side /= 2 {
+		thumb := makeThumbnail(img, side)
+		for _, quality := range thumbnailQualities {
+			buf.Reset()
+			if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, err
+			}
+			if maxBytes <= 0 || buf.Len() <= maxBytes {
+				return buf.Bytes(), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("thumbnail does not fit in %d bytes", maxBytes)
+}
+
+func thumbnailDataURI(path string, opener ImageOpener, maxSide, maxBytes int) (template.URL, error) {
+	img, err := opener.Open(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := encodeThumbnail(img, maxSide, maxBytes)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// fileURL builds a properly escaped file:// URL, so paths containing spaces,
+// '#' or '?' still resolve.
+func fileURL(path string) template.URL {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		// Windows drive letters: C:/x becomes /C:/x
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path}
+	return template.URL(u.String())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serves a generated gradient for any path except "missing.jpg"
+type gradientImageOpener struct {
+	width, height int
+}
+
+func (g gradientImageOpener) Open(path string) (image.Image, error) {
+	if filepath.Base(path) == "missing.jpg" {
+		return nil, errors.New("file not found")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, g.width, g.height))
+	for y := 0; y < g.height; y++ {
+		for x := 0; x < g.width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 7), uint8(y * 13), uint8((x ^ y) * 3), 255})
+		}
+	}
+	return img, nil
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	testCases := []struct {
+		name     string
+		width    int
+		height   int
+		maxSide  int
+		expected image.Point
+	}{
+		{"Landscape", 800, 600, 200, image.Point{200, 150}},
+		{"Portrait", 600, 800, 200, image.Point{150, 200}},
+		{"AlreadySmall", 100, 50, 200, image.Point{100, 50}},
+		{"VeryWide", 4000, 10, 200, image.Point{200, 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			img, _ := gradientImageOpener{tc.width, tc.height}.Open("x.jpg")
+			thumb := makeThumbnail(img, tc.maxSide)
+			if got := thumb.Bounds().Size(); got != tc.expected {
+				t.Errorf("Expected thumbnail size %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEncodeThumbnailRespectsByteCap(t *testing.T) {
+	img, _ := gradientImageOpener{1000, 800}.Open("x.jpg")
+
+	uncapped, err := encodeThumbnail(img, 400, 0)
+	if err != nil {
+		t.Fatalf("encodeThumbnail() error = %v", err)
+	}
+
+	maxBytes := len(uncapped) / 4
+	capped, err := encodeThumbnail(img, 400, maxBytes)
+	if err != nil {
+		t.Fatalf("encodeThumbnail() error = %v", err)
+	}
+	if len(capped) > maxBytes {
+		t.Errorf("Expected at most %d bytes, got %d", maxBytes, len(capped))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(capped)); err != nil {
+		t.Errorf("Capped thumbnail is not a valid JPEG: %v", err)
+	}
+
+	if _, err := encodeThumbnail(img, 400, 10); err == nil {
+		t.Errorf("Expected an error when no thumbnail fits the cap")
+	}
+}
+
+func TestFileURL(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{"/path/to/image1.jpg", "file:///path/to/image1.jpg"},
+		{"/path/to/image with spaces.jpg", "file:///path/to/image%20with%20spaces.jpg"},
+		{"/path/to/#1 photo?.jpg", "file:///path/to/%231%20photo%3F.jpg"},
+	}
+
+	for _, tc := range testCases {
+		if got := string(fileURL(tc.path)); got != tc.expected {
+			t.Errorf("fileURL(%q) = %q, expected %q", tc.path, got, tc.expected)
+		}
+	}
+
+	if got := string(fileURL("relative.jpg")); !strings.HasPrefix(got, "file:///") || !strings.HasSuffix(got, "/relative.jpg") {
+		t.Errorf("Expected relative paths to be made absolute, got %q", got)
+	}
+}
+
+func TestGenerateHTMLReportEmbedsThumbnails(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "report.html")
+	groups := groupMembers([][]string{{"/photos/a.jpg", "/photos/missing.jpg"}})
+	opts := HTMLOptions{
+		EmbedThumbnails:   true,
+		ThumbnailSize:     64,
+		ThumbnailMaxBytes: 16 * 1024,
+		Opener:            gradientImageOpener{640, 480},
+	}
+
+	if err := generateHTMLReport(groups, outputFile, opts); err != nil {
+		t.Fatalf("generateHTMLReport() error = %v", err)
+	}
+
+	content, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read generated HTML file: %v", err)
+	}
+	report := string(content)
+
+	const prefix = `<img src="data:image/jpeg;base64,`
+	start := strings.Index(report, prefix)
+	if start < 0 {
+		t.Fatalf("Expected an embedded thumbnail in the report")
+	}
+	encoded := report[start+len(prefix):]
+	encoded = html.UnescapeString(encoded[:strings.Index(encoded, `"`)])
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("Embedded thumbnail is not valid base64: %v", err)
+	}
+	thumb, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Embedded thumbnail is not a valid JPEG: %v", err)
+	}
+	if got := thumb.Bounds().Size(); got != (image.Point{64, 48}) {
+		t.Errorf("Expected a 64x48 thumbnail, got %v", got)
+	}
+
+	// Unreadable images fall back to a link
+	if !strings.Contains(report, `<img src="file:///photos/missing.jpg"`) {
+		t.Errorf("Expected a file URL for the unreadable image")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+// Transform is a rotation or mirroring that turns one image into another.
+type Transform string
+
+const (
+	TransformNone      Transform = ""
+	TransformMirror    Transform = "mirror"
+	TransformRotate180 Transform = "rotate-180"
+	TransformFlip      Transform = "flip"
+	TransformTranspose Transform = "transpose"
+	TransformRotate90  Transform = "rotate-90"
+	// TransformTransverse mirrors along the anti-diagonal.
+	TransformTransverse Transform = "transverse"
+	TransformRotate270  Transform = "rotate-270"
+)
+
+// iconTransforms lists every transform tried with -match-transforms, as the
+// EXIF orientation that displays an image that way. Rotations are clockwise.
+var iconTransforms = []struct {
+	Transform   Transform
+	orientation int
+}{
+	{TransformMirror, 2},
+	{TransformRotate180, 3},
+	{TransformFlip, 4},
+	{TransformTranspose, 5},
+	{TransformRotate90, 6},
+	{TransformTransverse, 7},
+	{TransformRotate270, 8},
+}
+
+// transformIcon returns the icon of the image transformed by the given EXIF
+// orientation. Icons are square, so this is a permutation of its pixels.
+func transformIcon(icon images4.IconT, orientation int) images4.IconT {
+	const n = images4.IconSize
+	if len(icon.Pixels) < 3*iconPixels {
+		return icon
+	}
+	result := images4.IconT{Pixels: make([]uint16, len(icon.Pixels)), ImgSize: icon.ImgSize}
+	if orientation >= 5 {
+		result.ImgSize = image.Point{icon.ImgSize.Y, icon.ImgSize.X}
+	}
+	for ch := 0; ch < 3; ch++ {
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				sx, sy := orientSource(orientation, x, y, n, n)
+				result.Pixels[n*(ch*n+y)+x] = icon.Pixels[n*(ch*n+sy)+sx]
+			}
+		}
+	}
+	return result
+}
+
+// closestTransform returns how b is best explained as a rotated or mirrored
+// copy of a, and its distance to that copy. The untransformed image wins
+// ties.
+func closestTransform(a, b images4.IconT) (Transform, float64) {
+	best, distance := TransformNone, iconDistance(a, b)
+	for _, t := range iconTransforms {
+		if d := iconDistance(transformIcon(a, t.orientation), b); d < distance {
+			best, distance = t.Transform, d
+		}
+	}
+	return best, distance
+}
+
+func transformLabel(t Transform) string {
+	switch t {
+	case TransformMirror:
+		return "mirrored copy"
+	case TransformRotate180:
+		return "rotated 180° copy"
+	case TransformFlip:
+		return "upside-down mirrored copy"
+	case TransformTranspose:
+		return "rotated 90° and mirrored copy"
+	case TransformRotate90:
+		return "rotated 90° copy"
+	case TransformTransverse:
+		return "rotated 270° and mirrored copy"
+	case TransformRotate270:
+		return "rotated 270° copy"
+	}
+	return string(t)
+}
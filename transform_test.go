@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/md5"
+	"testing"
+
+	"github.com/vitali-fedulov/images4"
+)
+
+func TestTransformIconMatchesTransformedImage(t *testing.T) {
+	src := testPattern(64, 48)
+	icon := images4.Icon(src)
+	for _, tc := range iconTransforms {
+		t.Run(string(tc.Transform), func(t *testing.T) {
+			want := images4.Icon(orientImage(src, tc.orientation))
+			got := transformIcon(icon, tc.orientation)
+			if got.ImgSize != want.ImgSize {
+				t.Errorf("Expected size %v, got %v", want.ImgSize, got.ImgSize)
+			}
+			if d := iconDistance(got, want); d > 0.05 {
+				t.Errorf("Transformed icon is %v away from the icon of the transformed image", d)
+			}
+			if transform, _ := closestTransform(icon, want); transform != tc.Transform {
+				t.Errorf("Expected closest transform %q, got %q", tc.Transform, transform)
+			}
+		})
+	}
+}
+
+func TestFindSimilarImagesMatchTransforms(t *testing.T) {
+	src := testPattern(64, 48)
+	info := func(path string, orientation int) ImageInfo {
+		return ImageInfo{Path: path, FileHash: md5.Sum([]byte(path)), Icon: images4.Icon(orientImage(src, orientation))}
+	}
+	infos := []ImageInfo{info("/a.jpg", 1), info("/rotated.jpg", 6), info("/mirrored.jpg", 2)}
+
+	if groups := findSimilarImages(infos, SimilarityOptions{Grouping: GroupingTransitive}); len(groups) != 0 {
+		t.Fatalf("Expected no groups without -match-transforms, got %v", groups)
+	}
+
+	for _, mode := range []GroupingMode{GroupingAnchor, GroupingTransitive, GroupingClique} {
+		t.Run(string(mode), func(t *testing.T) {
+			groups := findSimilarImages(infos, SimilarityOptions{Grouping: mode, MatchTransforms: true})
+			if len(groups) != 1 || len(groups[0].Members) != 3 {
+				t.Fatalf("Expected one group of three, got %v", groups)
+			}
+			want := map[string]Transform{"/a.jpg": TransformNone, "/rotated.jpg": TransformRotate90, "/mirrored.jpg": TransformMirror}
+			for _, member := range groups[0].Members {
+				if member.Transform != want[member.Path] {
+					t.Errorf("%s: expected transform %q, got %q", member.Path, want[member.Path], member.Transform)
+				}
+				if member.Score >= 1 {
+					t.Errorf("%s: expected a score below 1, got %v", member.Path, member.Score)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchTransformsKeepsUntransformedMatches(t *testing.T) {
+	infos := syntheticImageInfos(250, 5)
+	want := groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingTransitive})
+	got := groupByImageSimilarity(infos, SimilarityOptions{Grouping: GroupingTransitive, MatchTransforms: true})
+
+	grouped := make(map[string]int)
+	for n, group := range got {
+		for _, path := range group {
+			grouped[path] = n
+		}
+	}
+	for _, group := range want {
+		for _, path := range group[1:] {
+			if n, ok := grouped[path]; !ok || n != grouped[group[0]] {
+				t.Errorf("%s and %s are no longer grouped with -match-transforms", group[0], path)
+			}
+		}
+	}
+}